@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/hydravpn/hydra/pkg/client"
+	"github.com/hydravpn/hydra/pkg/crypto"
+	"github.com/hydravpn/hydra/pkg/protocol"
 	"github.com/hydravpn/hydra/pkg/server"
 	"github.com/hydravpn/hydra/pkg/transport"
 )
@@ -35,6 +41,12 @@ func main() {
 		runServer()
 	case "client":
 		runClient()
+	case "genkey":
+		runGenKey()
+	case "pubkey":
+		runPubKey()
+	case "genpsk":
+		runGenPSK()
 	case "version":
 		fmt.Println("HydraVPN v0.1.0 (MVP)")
 	case "help":
@@ -53,20 +65,47 @@ func printUsage() {
 	fmt.Println("Commands:")
 	fmt.Println("  server    Start VPN server")
 	fmt.Println("  client    Connect to VPN server")
+	fmt.Println("  genkey    Generate a private key (to stdout, or to a new file)")
+	fmt.Println("  pubkey    Read a private key from stdin and print its public key")
+	fmt.Println("  genpsk    Generate a pre-shared key")
 	fmt.Println("  version   Show version")
 	fmt.Println("  help      Show this help")
 	fmt.Println()
 	fmt.Println("Server options:")
 	fmt.Println("  --listen <addr>     Listen address (default: :8443)")
 	fmt.Println("  --transport <type>  Transport: websocket, quic, obfs (default: websocket)")
+	fmt.Println("  --key <file>        Private key file (created if missing)")
+	fmt.Println("  --peers <file>      Allowed clients, one \"<public-key> <name> [<psk>]\" per line")
+	fmt.Println("  --require-pq        Reject clients without hybrid post-quantum key exchange")
+	fmt.Println("  --ciphers <list>    Accepted cipher suites: aes-256-gcm, xchacha20-poly1305")
+	fmt.Println("  --subnet6 <prefix>  IPv6 prefix for clients (empty disables IPv6)")
+	fmt.Println("  --dns <list>        DNS servers pushed to clients")
+	fmt.Println("  --search <list>     DNS search domains pushed to clients")
+	fmt.Println("  --routes <list>     Networks clients route through the VPN (default: all)")
+	fmt.Println("  --mtu <bytes>       Tunnel MTU pushed to clients")
+	fmt.Println("  --padding <policy>  Data packet padding: none, multiple:<n>, mtu:<n>, random:<min>-<max>")
+	fmt.Println("  --compress          Let clients compress data packets (leaks content through sizes)")
 	fmt.Println()
 	fmt.Println("Client options:")
 	fmt.Println("  --server <addr>     Server address (default: 127.0.0.1:8443)")
+	fmt.Println("  --server-key <key>  Server public key (base64, required)")
+	fmt.Println("  --key <file>        Private key file (created if missing)")
+	fmt.Println("  --psk <file>        Pre-shared key file (must match the server's peers entry)")
 	fmt.Println("  --transport <type>  Transport: websocket, quic, obfs (default: websocket)")
+	fmt.Println("  --pq                Offer hybrid post-quantum key exchange (default: true)")
+	fmt.Println("  --require-pq        Refuse servers without post-quantum key exchange")
+	fmt.Println("  --ciphers <list>    Offered cipher suites in preference order")
+	fmt.Println("  --padding <policy>  Requested data packet padding (the server's policy wins)")
+	fmt.Println("  --compress          Compress data packets if the server allows it")
+	fmt.Println("  --legacy-handshake  Speak cleartext protocol version 1 to older servers")
+	fmt.Println()
+	fmt.Println("Genkey options:")
+	fmt.Println("  --force             Replace an existing key file")
 	fmt.Println()
 	fmt.Println("Examples:")
+	fmt.Println("  hydra genkey server.key && hydra pubkey < server.key")
 	fmt.Println("  sudo hydra server --listen :8443")
-	fmt.Println("  sudo hydra client --server 192.168.1.100:8443")
+	fmt.Println("  sudo hydra client --server 192.168.1.100:8443 --server-key <key>")
 }
 
 func runServer() {
@@ -75,12 +114,53 @@ func runServer() {
 	serverFlags := flag.NewFlagSet("server", flag.ExitOnError)
 	listen := serverFlags.String("listen", ":8443", "Listen address")
 	transportType := serverFlags.String("transport", "websocket", "Transport type")
+	keyFile := serverFlags.String("key", "", "Private key file")
+	peersFile := serverFlags.String("peers", "", "Peers file")
+	requirePQ := serverFlags.Bool("require-pq", false, "Require hybrid post-quantum key exchange")
+	ciphers := serverFlags.String("ciphers", "", "Accepted cipher suites (comma separated)")
+	subnet6 := serverFlags.String("subnet6", server.DefaultSubnet6, "IPv6 prefix for clients (empty disables IPv6)")
+	dns := serverFlags.String("dns", "", "DNS servers pushed to clients (comma separated)")
+	search := serverFlags.String("search", "", "DNS search domains pushed to clients (comma separated)")
+	routes := serverFlags.String("routes", "", "Networks clients route through the VPN (comma separated, default all)")
+	mtu := serverFlags.Int("mtu", 0, "Tunnel MTU pushed to clients")
+	padding := serverFlags.String("padding", "none", "Data packet padding policy")
+	compress := serverFlags.Bool("compress", false, "Let clients compress data packets")
 	
 	serverFlags.Parse(os.Args[2:])
 	
 	cfg := server.DefaultConfig()
 	cfg.ListenAddr = *listen
 	cfg.TransportType = parseTransport(*transportType)
+	cfg.PrivateKeyFile = *keyFile
+	cfg.PeersFile = *peersFile
+	cfg.RequirePostQuantum = *requirePQ
+	if *ciphers != "" {
+		suites, err := crypto.ParseCipherSuites(*ciphers)
+		if err != nil {
+			log.Fatalf("Invalid --ciphers: %v", err)
+		}
+		cfg.CipherSuites = suites
+	}
+	cfg.Subnet6 = nil
+	if *subnet6 != "" {
+		_, prefix, err := net.ParseCIDR(*subnet6)
+		if err != nil {
+			log.Fatalf("Invalid --subnet6: %v", err)
+		}
+		cfg.Subnet6 = prefix
+	}
+	paddingPolicy, err := protocol.ParsePaddingPolicy(*padding)
+	if err != nil {
+		log.Fatalf("Invalid --padding: %v", err)
+	}
+	cfg.Padding = paddingPolicy
+	cfg.Compression = *compress
+	if err := applyClientConfig(cfg.ClientConfig, *dns, *search, *routes, *mtu); err != nil {
+		log.Fatalf("Invalid client configuration: %v", err)
+	}
+	if cfg.Subnet6 != nil && cfg.ClientConfig.MTU != 0 && cfg.ClientConfig.MTU < protocol.MinMTU6 {
+		log.Fatalf("Invalid --mtu: IPv6 needs at least %d, pass --subnet6 \"\" for an IPv4-only tunnel", protocol.MinMTU6)
+	}
 	
 	srv, err := server.New(cfg)
 	if err != nil {
@@ -91,6 +171,8 @@ func runServer() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 	
+	log.Printf("Server public key: %s", crypto.EncodeKey(srv.PublicKey()))
+	
 	// Wait for interrupt
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -106,13 +188,50 @@ func runClient() {
 
 	clientFlags := flag.NewFlagSet("client", flag.ExitOnError)
 	serverAddr := clientFlags.String("server", "127.0.0.1:8443", "Server address")
+	serverKey := clientFlags.String("server-key", "", "Server public key (base64)")
 	transportType := clientFlags.String("transport", "websocket", "Transport type")
+	keyFile := clientFlags.String("key", "", "Private key file")
+	pskFile := clientFlags.String("psk", "", "Pre-shared key file")
+	pq := clientFlags.Bool("pq", true, "Offer hybrid post-quantum key exchange")
+	requirePQ := clientFlags.Bool("require-pq", false, "Require hybrid post-quantum key exchange")
+	ciphers := clientFlags.String("ciphers", "", "Offered cipher suites in preference order (comma separated)")
+	padding := clientFlags.String("padding", "none", "Requested data packet padding policy")
+	compress := clientFlags.Bool("compress", false, "Compress data packets if the server allows it")
+	legacyHandshake := clientFlags.Bool("legacy-handshake", false, "Speak cleartext protocol version 1 to older servers")
 
 	clientFlags.Parse(os.Args[2:])
 
+	serverPublicKey, err := crypto.ParseKey(*serverKey)
+	if err != nil {
+		log.Fatalf("Invalid --server-key: %v", err)
+	}
+
 	cfg := client.DefaultConfig()
 	cfg.ServerAddr = *serverAddr
+	cfg.ServerPublicKey = serverPublicKey
+	cfg.PrivateKeyFile = *keyFile
+	if *pskFile != "" {
+		cfg.PresharedKey, err = crypto.LoadPresharedKey(*pskFile)
+		if err != nil {
+			log.Fatalf("Invalid --psk: %v", err)
+		}
+	}
 	cfg.TransportType = parseTransport(*transportType)
+	cfg.PostQuantum = *pq
+	cfg.RequirePostQuantum = *requirePQ
+	if *ciphers != "" {
+		suites, err := crypto.ParseCipherSuites(*ciphers)
+		if err != nil {
+			log.Fatalf("Invalid --ciphers: %v", err)
+		}
+		cfg.CipherSuites = suites
+	}
+	cfg.Padding, err = protocol.ParsePaddingPolicy(*padding)
+	if err != nil {
+		log.Fatalf("Invalid --padding: %v", err)
+	}
+	cfg.Compression = *compress
+	cfg.LegacyHandshake = *legacyHandshake
 	cfg.AutoReconnect = false // Disable auto-reconnect on manual disconnect
 
 	cli, err := client.New(cfg)
@@ -143,6 +262,90 @@ func runClient() {
 	// Disconnect is called in defer
 }
 
+func runGenKey() {
+	genKeyFlags := flag.NewFlagSet("genkey", flag.ExitOnError)
+	force := genKeyFlags.Bool("force", false, "Overwrite an existing key file")
+	genKeyFlags.Parse(os.Args[2:])
+
+	kp, err := crypto.GenerateKeyPair()
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+	if genKeyFlags.NArg() == 0 {
+		fmt.Println(crypto.EncodeKey(kp.PrivateKey))
+		return
+	}
+
+	path := genKeyFlags.Arg(0)
+	if err := crypto.SaveKeyPair(path, kp, *force); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			log.Fatalf("%s already exists, pass --force to replace it", path)
+		}
+		log.Fatalf("Failed to save key: %v", err)
+	}
+}
+
+func runPubKey() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("Failed to read private key: %v", err)
+	}
+	privateKey, err := crypto.ParseKey(line)
+	if err != nil {
+		log.Fatalf("Invalid private key: %v", err)
+	}
+	fmt.Println(crypto.EncodeKey(crypto.NewKeyPair(privateKey).PublicKey))
+}
+
+func runGenPSK() {
+	psk, err := crypto.GeneratePresharedKey()
+	if err != nil {
+		log.Fatalf("Failed to generate pre-shared key: %v", err)
+	}
+	fmt.Println(crypto.EncodeKey(psk))
+}
+
+// applyClientConfig overrides the pushed client settings given on the command line
+func applyClientConfig(cc *protocol.ClientConfig, dns, search, routes string, mtu int) error {
+	if dns != "" {
+		cc.DNS = nil
+		for _, s := range strings.Split(dns, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				return fmt.Errorf("invalid DNS server %q", s)
+			}
+			cc.DNS = append(cc.DNS, ip)
+		}
+	}
+	if search != "" {
+		cc.SearchDomains = nil
+		for _, s := range strings.Split(search, ",") {
+			domain := strings.TrimSpace(s)
+			if !protocol.ValidSearchDomain(domain) {
+				return fmt.Errorf("invalid search domain %q", s)
+			}
+			cc.SearchDomains = append(cc.SearchDomains, domain)
+		}
+	}
+	if routes != "" {
+		cc.Routes = nil
+		for _, s := range strings.Split(routes, ",") {
+			_, route, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			cc.Routes = append(cc.Routes, route)
+		}
+	}
+	if mtu != 0 {
+		if mtu < protocol.MinMTU || mtu > 65535 {
+			return fmt.Errorf("invalid MTU %d", mtu)
+		}
+		cc.MTU = uint16(mtu)
+	}
+	return nil
+}
+
 func parseTransport(t string) transport.TransportType {
 	switch t {
 	case "quic":
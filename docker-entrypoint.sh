@@ -46,6 +46,19 @@ echo ""
 echo "✅ NAT configured for interface: $MAIN_IF"
 echo "✅ VPN subnet: 10.8.0.0/24"
 echo ""
+
+# Create the server key and an empty peers file on first start
+mkdir -p /etc/hydra
+if [ ! -f /etc/hydra/server.key ]; then
+    /app/hydra genkey /etc/hydra/server.key
+    echo "✅ Generated server key in /etc/hydra/server.key"
+fi
+if [ ! -f /etc/hydra/peers ]; then
+    echo "# <client-public-key> <name> [<preshared-key>]" > /etc/hydra/peers
+    echo "⚠️  No peers yet: add clients to /etc/hydra/peers and restart"
+fi
+echo "Server public key: $(/app/hydra pubkey < /etc/hydra/server.key)"
+echo ""
 echo "Starting HydraVPN server..."
 echo ""
 
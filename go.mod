@@ -1,12 +1,13 @@
 module github.com/hydravpn/hydra
 
-go 1.21
+go 1.24
 
 require (
 	github.com/gorilla/websocket v1.5.1
 	github.com/quic-go/quic-go v0.40.1
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
 	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
 )
 
 require (
@@ -18,6 +19,5 @@ require (
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/mod v0.14.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/tools v0.15.0 // indirect
 )
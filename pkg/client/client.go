@@ -3,10 +3,12 @@ package client
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hydravpn/hydra/pkg/crypto"
@@ -21,27 +23,85 @@ type Client struct {
 	transport     transport.Transport
 	conn          transport.Connection
 	keyPair       *crypto.KeyPair
-	cryptoSession *crypto.Session
+	cookies       *crypto.CookieGenerator
+	handshakes    *crypto.HeaderProtector // Masks handshake inits and unmasks the answers; nil with LegacyHandshake
+	keyring       *crypto.Keyring
 	tunDevice     *tun.TUNDevice
 	
 	sessionID     uint64
 	assignedIP    net.IP
 	serverIP      net.IP
+	subnet        *net.IPNet
+	assignedIP6   net.IP     // nil unless the session is dual-stack
+	serverIP6     net.IP
+	subnet6       *net.IPNet
+	network       *protocol.ClientConfig // Pushed by the server, with client defaults filled in; guarded by connMu
+	version       uint8  // Negotiated protocol version
+	capabilities  uint32 // Capability flags enabled for the session
+	padding       protocol.PaddingPolicy // Padding of data packets, with CapabilityPadding
+	maxPacketSize int                    // Largest packet sent to the server; bigger ones are fragmented
+	fragmentID    atomic.Uint32
+	reassembler   *protocol.Reassembler  // Only used by receiveLoop
+	link          *protocol.LinkMonitor
+	batcher       *protocol.Batcher      // Coalesces data sent to the server, with CapabilityBatching
+	compressor    *protocol.Compressor   // Only used by tunReadLoop, with CapabilityCompression
+	decompressor  *protocol.Decompressor // Only used by receiveLoop
+	headers       *crypto.HeaderProtector // Masks headers after the handshake; set under writeMu
+	ticket        []byte // Resumption ticket for the next reconnect, guarded by connMu
+	disconnect    *protocol.DisconnectMessage // Why the server closed the session, guarded by connMu
 	
 	ctx           context.Context
 	cancel        context.CancelFunc
+	connCancel    context.CancelFunc // Stops the loops of the current connection, guarded by connMu
 	wg            sync.WaitGroup
 	
 	connected     bool
 	connMu        sync.RWMutex
+	writeMu       sync.Mutex
+}
+
+// maxHandshakeAttempts bounds the cookie round trips of one handshake
+const maxHandshakeAttempts = 3
+
+// packetHeadroom is the room left in front of IP packets read from the
+// TUN device for the header and crypto prefix, so they can be sealed in place
+const packetHeadroom = protocol.HeaderSize + crypto.PrefixSize
+
+// ErrServerKeyMismatch is returned when the server cannot prove possession
+// of the private key matching the pinned server public key
+var ErrServerKeyMismatch = errors.New("server public key mismatch: server failed to authenticate")
+
+// ErrPostQuantumRequired is returned when the server declines hybrid mode
+// but the client is configured to require it
+var ErrPostQuantumRequired = errors.New("server does not support post-quantum key exchange")
+
+// DisconnectError is returned by Connect when the server completes the
+// handshake only to refuse the session
+type DisconnectError struct {
+	Message protocol.DisconnectMessage
+}
+
+func (e *DisconnectError) Error() string {
+	return "server refused the session: " + e.Message.String()
 }
 
 // Config holds client configuration
 type Config struct {
 	ServerAddr    string
+	ServerPublicKey [32]byte // Pinned server static key
+	PrivateKeyFile string    // Client identity; ephemeral if empty
+	PresharedKey  [32]byte   // Must match the server's entry for this client, zero if none
 	TransportType transport.TransportType
 	AutoReconnect bool
 	ReconnectDelay time.Duration
+	RekeyAfterTime  time.Duration // Rotate keys after this long (0 disables)
+	RekeyAfterBytes uint64        // Rotate keys after this much traffic (0 disables)
+	PostQuantum        bool // Offer a hybrid X25519 + ML-KEM-768 handshake
+	RequirePostQuantum bool // Refuse servers that only do classic X25519
+	CipherSuites    []crypto.CipherSuite // Offered to the server in preference order
+	Padding         protocol.PaddingPolicy // Requested data packet padding; the server may override it
+	Compression     bool                   // Offer to compress data packets; sizes then leak content
+	LegacyHandshake bool                   // Speak protocol version 1, in the clear, to servers that cannot unmask handshakes
 }
 
 // DefaultConfig returns default client configuration
@@ -51,6 +111,10 @@ func DefaultConfig() *Config {
 		TransportType:  transport.TransportWebSocket,
 		AutoReconnect:  true,
 		ReconnectDelay: 5 * time.Second,
+		RekeyAfterTime:  protocol.RekeyAfterTime,
+		RekeyAfterBytes: protocol.RekeyAfterBytes,
+		PostQuantum:     true,
+		CipherSuites:    crypto.DefaultCipherSuites(),
 	}
 }
 
@@ -60,10 +124,36 @@ func New(cfg *Config) (*Client, error) {
 		cfg = DefaultConfig()
 	}
 	
-	// Generate client key pair
-	keyPair, err := crypto.GenerateKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	if cfg.ServerPublicKey == [32]byte{} {
+		return nil, errors.New("server public key is required")
+	}
+	if cfg.RequirePostQuantum && !cfg.PostQuantum {
+		return nil, errors.New("post-quantum key exchange is required but disabled")
+	}
+	if len(cfg.CipherSuites) == 0 || len(cfg.CipherSuites) > protocol.MaxCipherSuites {
+		return nil, fmt.Errorf("between 1 and %d cipher suites must be offered", protocol.MaxCipherSuites)
+	}
+	if err := cfg.Padding.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid padding policy: %w", err)
+	}
+	
+	// Load client identity, or generate a throwaway one
+	var keyPair *crypto.KeyPair
+	var err error
+	if cfg.PrivateKeyFile != "" {
+		var created bool
+		keyPair, created, err = crypto.LoadOrCreateKeyPair(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private key: %w", err)
+		}
+		if created {
+			log.Printf("Generated new private key in %s", cfg.PrivateKeyFile)
+		}
+	} else {
+		keyPair, err = crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key pair: %w", err)
+		}
 	}
 	
 	// Create transport
@@ -79,12 +169,24 @@ func New(cfg *Config) (*Client, error) {
 		t = transport.NewWebSocketTransport(nil)
 	}
 	
+	// Handshakes are masked with a key only holders of the server key know
+	var handshakes *crypto.HeaderProtector
+	if !cfg.LegacyHandshake {
+		handshakes, err = crypto.NewHandshakeProtector(cfg.ServerPublicKey, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive handshake protection keys: %w", err)
+		}
+	}
+	
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	return &Client{
 		config:    cfg,
 		transport: t,
 		keyPair:   keyPair,
+		cookies:   crypto.NewCookieGenerator(cfg.ServerPublicKey),
+		handshakes: handshakes,
+		link:      protocol.NewLinkMonitor(),
 		ctx:       ctx,
 		cancel:    cancel,
 	}, nil
@@ -100,18 +202,39 @@ func (c *Client) Connect() error {
 	if err != nil {
 		return fmt.Errorf("failed to connect: %w", err)
 	}
+	c.writeMu.Lock()
 	c.conn = conn
+	c.writeMu.Unlock()
+	c.maxPacketSize = transport.MessageLimit(conn, protocol.BufferSize)
+	c.reassembler = protocol.NewReassembler()
 	
 	log.Printf("Connected, performing handshake...")
 	
 	// Perform handshake
-	if err := c.performHandshake(); err != nil {
+	if err := c.performHandshake(c.maxVersion()); err != nil {
 		conn.Close()
 		return fmt.Errorf("handshake failed: %w", err)
 	}
 	
 	log.Printf("Handshake complete, session ID: %d", c.sessionID)
 	log.Printf("Assigned VPN IP: %s, Server IP: %s", c.assignedIP, c.serverIP)
+	if c.assignedIP6 != nil {
+		log.Printf("Assigned VPN IPv6: %s, Server IPv6: %s", c.assignedIP6, c.serverIP6)
+	}
+	
+	c.compressor, c.decompressor = nil, nil
+	if c.capabilities&protocol.CapabilityCompression != 0 {
+		c.compressor = protocol.NewCompressor()
+		c.decompressor = protocol.NewDecompressor()
+		log.Printf("Compressing data packets")
+	}
+	
+	// Coalesce data packets if the server takes batches
+	c.batcher = nil
+	if c.capabilities&protocol.CapabilityBatching != 0 {
+		limit := c.maxPacketSize - protocol.HeaderSize - c.keyring.Overhead()
+		c.batcher = protocol.NewBatcher(packetHeadroom, limit, c.writeSealed)
+	}
 	
 	// Extract VPN server IP (without port)
 	serverHost := c.config.ServerAddr
@@ -124,15 +247,25 @@ func (c *Client) Connect() error {
 		}
 	}
 
+	c.connMu.RLock()
+	network := c.network
+	c.connMu.RUnlock()
+
+	// Loops of this connection stop when it is torn down
+	ctx, cancel := context.WithCancel(c.ctx)
+
 	// Create TUN device with assigned IP
 	tunConfig := &tun.Config{
 		Name:        "hydra0",
-		MTU:         1400,
+		MTU:         int(network.MTU),
 		LocalIP:     c.assignedIP,
 		RemoteIP:    c.serverIP,
+		Subnet:      c.subnet,
+		LocalIP6:    c.assignedIP6,
+		RemoteIP6:   c.serverIP6,
+		Subnet6:     c.subnet6,
 		VPNServerIP: serverHost, // For route exclusion
 	}
-	_, tunConfig.Subnet, _ = net.ParseCIDR("10.8.0.0/24")
 
 	tunDev, err := tun.New(tunConfig)
 	if err != nil {
@@ -142,69 +275,131 @@ func (c *Client) Connect() error {
 		c.tunDevice = tunDev
 		log.Printf("Created TUN interface: %s", tunDev.Name())
 
-		// Set default route to redirect all traffic through VPN
-		if err := tunDev.SetDefaultRoute(); err != nil {
+		if len(network.Routes) > 0 {
+			// Split tunnel: only the pushed routes go through the VPN
+			if err := tunDev.AddRoutes(network.Routes); err != nil {
+				log.Printf("Warning: Failed to add routes: %v", err)
+			} else {
+				log.Printf("Routing %d networks through VPN", len(network.Routes))
+			}
+		} else if err := tunDev.SetDefaultRoute(); err != nil {
+			// Set default route to redirect all traffic through VPN
 			log.Printf("Warning: Failed to set default route: %v", err)
 			log.Printf("Traffic will NOT be routed through VPN")
 		} else {
 			log.Printf("All traffic now routes through VPN")
 		}
 
-		// Configure DNS to use public DNS servers
-		if err := tunDev.SetDNS(); err != nil {
+		// Configure DNS to use the pushed servers
+		if err := tunDev.SetDNS(network.DNS, network.SearchDomains); err != nil {
 			log.Printf("Warning: Failed to set DNS: %v", err)
 		}
 
 		// Start reading from TUN
 		c.wg.Add(1)
-		go c.tunReadLoop()
+		go c.tunReadLoop(ctx)
 	}
 
 	c.connMu.Lock()
 	c.connected = true
+	c.connCancel = cancel
 	c.connMu.Unlock()
 
 	// Start receiving from server
 	c.wg.Add(1)
-	go c.receiveLoop()
+	go c.receiveLoop(ctx)
 
 	// Start keepalive
 	c.wg.Add(1)
-	go c.keepaliveLoop()
+	go c.keepaliveLoop(ctx, network.KeepAlive)
 
 	log.Println("VPN tunnel established successfully!")
 
 	return nil
 }
 
-// performHandshake performs the cryptographic handshake
-func (c *Client) performHandshake() error {
-	// Create handshake init
-	hsInit := &protocol.HandshakeInit{
-		ClientPublicKey: c.keyPair.PublicKey,
-		Timestamp:       time.Now().Unix(),
+// performHandshake performs the cryptographic handshake, starting with the
+// given protocol version
+func (c *Client) performHandshake(version uint8) error {
+	// Create handshake init, sealed to the pinned server key
+	hs := crypto.NewInitiatorHandshake(c.keyPair, c.config.ServerPublicKey)
+	defer hs.Destroy()
+	hs.SetPresharedKey(c.config.PresharedKey)
+	hsInit := &protocol.HandshakeInit{Version: version}
+	if c.config.PostQuantum {
+		kemPublicKey, err := hs.OfferKEM()
+		if err != nil {
+			return fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
+		hsInit.Flags |= protocol.HandshakeFlagHybrid
+		hsInit.KEMPublicKey = kemPublicKey
 	}
-	rand.Read(hsInit.RandomPadding[:])
 	
-	// Send handshake init
-	initPayload := protocol.MarshalHandshakeInit(hsInit)
-	initPacket := protocol.NewPacket(protocol.PacketTypeHandshakeInit, 0, initPayload)
-	
-	if _, err := c.conn.Write(initPacket.Marshal()); err != nil {
-		return fmt.Errorf("failed to send handshake init: %w", err)
+	// Present the ticket of the previous connection to get its session ID
+	// and IP back. Tickets are single use, and only fit an init of the
+	// version they were issued under.
+	c.connMu.Lock()
+	ticket := c.ticket
+	c.ticket = nil
+	c.connMu.Unlock()
+	if len(ticket) != protocol.ResumptionTicketLen(version) {
+		ticket = nil
+	}
+	if ticket != nil {
+		hsInit.Flags |= protocol.HandshakeFlagResume
+		hsInit.Ticket = ticket
+		hs.MixTicket(ticket)
 	}
 	
-	// Receive handshake response
-	buf := make([]byte, 4096)
-	n, err := c.conn.Read(buf)
+	// The header is fixed by the init size and bound into the transcript
+	initHeader := protocol.NewHeader(protocol.PacketTypeHandshakeInit, 0, hsInit.Size())
+	initHeader.Version = version
+	hs.MixHeader(initHeader.Marshal())
+	
+	initPayload := &protocol.InitPayload{
+		Timestamp:    protocol.NewTimestamp(time.Now()),
+		MinVersion:   protocol.MinProtocolVersion,
+		MaxVersion:   c.maxVersion(),
+		Capabilities: c.offeredCapabilities(),
+		Padding:      c.config.Padding,
+	}
+	for i, suite := range c.config.CipherSuites {
+		initPayload.CipherSuites[i] = uint8(suite)
+	}
+	ephemeral, encryptedStatic, encryptedPayload, err := hs.SealInit(protocol.MarshalInitPayload(initPayload, version))
 	if err != nil {
-		return fmt.Errorf("failed to read handshake response: %w", err)
+		return fmt.Errorf("failed to create handshake init: %w", err)
 	}
 	
-	// Parse response packet
-	respPacket, err := protocol.UnmarshalPacket(buf[:n])
+	hsInit.EphemeralPublicKey = ephemeral
+	hsInit.EncryptedStatic = encryptedStatic
+	hsInit.EncryptedPayload = encryptedPayload
+	rand.Read(hsInit.RandomPadding[:])
+	
+	// Send handshake init and wait for the response
+	respPacket, err := c.exchangeHandshake(initHeader, protocol.MarshalHandshakeInit(hsInit))
 	if err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+		return err
+	}
+	
+	// The server speaks other versions: start over with the newest one we
+	// share. The answer is unauthenticated, but the server refuses an init
+	// whose version contradicts the sealed version range.
+	if respPacket.Header.Type == protocol.PacketTypeVersionNegotiation {
+		vn, err := protocol.UnmarshalVersionNegotiation(respPacket.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to parse version negotiation: %w", err)
+		}
+		fallback, ok := protocol.NegotiateVersion(vn.MinVersion, vn.MaxVersion, protocol.MinProtocolVersion, c.maxVersion())
+		if !ok || fallback >= version {
+			return fmt.Errorf("%w: server speaks versions %d-%d, client %d-%d", protocol.ErrUnsupportedVersion,
+				vn.MinVersion, vn.MaxVersion, protocol.MinProtocolVersion, c.maxVersion())
+		}
+		log.Printf("Server does not speak protocol version %d, retrying with %d", version, fallback)
+		c.connMu.Lock()
+		c.ticket = ticket
+		c.connMu.Unlock()
+		return c.performHandshake(fallback)
 	}
 	
 	if respPacket.Header.Type != protocol.PacketTypeHandshakeResponse {
@@ -212,88 +407,336 @@ func (c *Client) performHandshake() error {
 	}
 	
 	// Parse handshake response
-	hsResp, err := protocol.UnmarshalHandshakeResponse(respPacket.Payload)
+	hsResp, err := protocol.UnmarshalHandshakeResponse(respPacket.Payload, version)
 	if err != nil {
 		return fmt.Errorf("failed to parse handshake response: %w", err)
 	}
 	
-	// Compute shared secret
-	sharedSecret, err := crypto.ComputeSharedSecret(c.keyPair.PrivateKey, hsResp.ServerPublicKey)
+	// Verify the server holds the pinned static key
+	hs.MixHeader(respPacket.Header.Marshal())
+	paramsData, err := hs.OpenResponse(hsResp.EphemeralPublicKey, hsResp.KEMCiphertext, hsResp.EncryptedParams)
 	if err != nil {
-		return fmt.Errorf("failed to compute shared secret: %w", err)
+		if errors.Is(err, crypto.ErrHandshakeAuth) {
+			return ErrServerKeyMismatch
+		}
+		return fmt.Errorf("failed to process handshake response: %w", err)
+	}
+	
+	params, err := protocol.UnmarshalSessionParams(paramsData, version)
+	if err != nil {
+		return fmt.Errorf("failed to parse session params: %w", err)
+	}
+	
+	if params.Subnet > 32 {
+		return fmt.Errorf("invalid subnet length %d", params.Subnet)
+	}
+	
+	// Settings the server did not push keep their defaults
+	network := defaultNetwork()
+	if hsResp.Flags&protocol.HandshakeFlagExtensions != 0 {
+		pushed, err := protocol.UnmarshalClientConfig(paramsData[protocol.SessionParamsLen(version):])
+		if err != nil {
+			return fmt.Errorf("failed to parse pushed configuration: %w", err)
+		}
+		if err := mergeNetwork(network, pushed, params.Capabilities&protocol.CapabilityIPv6 != 0); err != nil {
+			return err
+		}
+	}
+	
+	if hs.Hybrid() {
+		log.Printf("Using hybrid post-quantum key exchange (X25519 + ML-KEM-768)")
+	} else if c.config.RequirePostQuantum {
+		return ErrPostQuantumRequired
+	}
+	
+	if params.Version != version {
+		return fmt.Errorf("server picked protocol version %d instead of %d", params.Version, version)
+	}
+	
+	suite := crypto.CipherSuite(params.CipherSuite)
+	if _, err := crypto.SelectCipherSuite([]crypto.CipherSuite{suite}, c.config.CipherSuites); err != nil {
+		return fmt.Errorf("server picked cipher suite %s that was not offered", suite)
 	}
 	
 	// Derive session keys (client is initiator)
-	// Use shared secret as salt (same as server)
-	salt := sharedSecret[:]
-	c.cryptoSession, err = crypto.DeriveSessionKeys(sharedSecret, true, salt)
+	keyring, err := hs.Keyring(suite)
 	if err != nil {
 		return fmt.Errorf("failed to derive keys: %w", err)
 	}
+	var headers *crypto.HeaderProtector
+	if params.Capabilities&protocol.CapabilityHeaderProtection != 0 {
+		if headers, err = hs.HeaderProtector(); err != nil {
+			keyring.Destroy()
+			return fmt.Errorf("failed to derive header protection keys: %w", err)
+		}
+	}
+	c.writeMu.Lock()
+	c.headers = headers
+	c.writeMu.Unlock()
+	
+	// Keys of a previous connection are no longer needed
+	if c.keyring != nil {
+		c.keyring.Destroy()
+	}
+	c.keyring = keyring
+	
+	if ticket != nil && params.SessionID == c.sessionID {
+		log.Printf("Resumed previous session")
+	}
 	
 	// Store session info
-	c.sessionID = hsResp.SessionID
-	c.assignedIP = net.IP(hsResp.AssignedIP[:])
-	c.serverIP = net.IP(hsResp.ServerIP[:])
+	c.sessionID = params.SessionID
+	c.assignedIP = net.IP(params.AssignedIP[:])
+	c.serverIP = net.IP(params.ServerIP[:])
+	c.subnet = &net.IPNet{
+		IP:   c.assignedIP.Mask(net.CIDRMask(int(params.Subnet), 32)),
+		Mask: net.CIDRMask(int(params.Subnet), 32),
+	}
+	c.connMu.Lock()
+	c.network = network
+	c.connMu.Unlock()
+	c.assignedIP6, c.serverIP6, c.subnet6 = nil, nil, nil
+	if params.Capabilities&protocol.CapabilityIPv6 != 0 {
+		c.assignedIP6 = net.IP(params.AssignedIP6[:])
+		c.serverIP6 = net.IP(params.ServerIP6[:])
+		c.subnet6 = &net.IPNet{
+			IP:   c.assignedIP6.Mask(net.CIDRMask(int(params.Prefix6), 128)),
+			Mask: net.CIDRMask(int(params.Prefix6), 128),
+		}
+	}
+	c.version = params.Version
+	c.capabilities = params.Capabilities
+	c.padding = protocol.PaddingPolicy{}
+	if c.capabilities&protocol.CapabilityPadding != 0 {
+		if err := params.Padding.Validate(); err != nil {
+			return fmt.Errorf("server picked %w", err)
+		}
+		c.padding = params.Padding
+		log.Printf("Padding data packets: %s", c.padding)
+	}
+	if c.config.Padding.Mode != protocol.PaddingNone && protocol.VersionCapabilities(c.version)&protocol.CapabilityPadding == 0 {
+		log.Printf("Warning: protocol version %d cannot pad, data packets are sent unpadded", c.version)
+	}
+	log.Printf("Using protocol version %d, cipher suite %s", c.version, suite)
+	
+	// A server that cannot take the session assigns no address and
+	// follows up with a disconnect saying why
+	if c.assignedIP.IsUnspecified() {
+		return c.readRefusal()
+	}
 	
 	return nil
 }
 
-// tunReadLoop reads from TUN and sends to server
-func (c *Client) tunReadLoop() {
+// readRefusal reads the disconnect that follows a handshake without an
+// assigned address and returns it as a *DisconnectError
+func (c *Client) readRefusal() error {
+	buf := protocol.GetBuffer()
+	defer protocol.PutBuffer(buf)
+	
+	n, err := c.conn.Read(*buf)
+	if err != nil {
+		return fmt.Errorf("server assigned no address: %w", err)
+	}
+	if err := c.unprotect((*buf)[:n]); err != nil || !c.handlePacket((*buf)[:n]) {
+		return errors.New("server assigned no address")
+	}
+	
+	c.connMu.Lock()
+	msg := c.disconnect
+	c.disconnect = nil
+	c.connMu.Unlock()
+	return &DisconnectError{Message: *msg}
+}
+
+// exchangeHandshake sends a marshaled handshake init and returns the
+// server's answer. If the server is under load and replies with a cookie,
+// the init is resent with the cookie MAC. Unless the client speaks the
+// legacy handshake, the headers of the init and the answer are masked.
+func (c *Client) exchangeHandshake(header protocol.PacketHeader, initPayload []byte) (*protocol.Packet, error) {
+	buf := make([]byte, 4096)
+	
+	for attempt := 0; attempt < maxHandshakeAttempts; attempt++ {
+		c.cookies.AddMACs(initPayload)
+		initPacket := &protocol.Packet{Header: header, Payload: initPayload}
+		initData := initPacket.Marshal()
+		if c.handshakes != nil {
+			if err := c.handshakes.Protect(initData, protocol.HeaderSize); err != nil {
+				return nil, fmt.Errorf("failed to mask handshake init: %w", err)
+			}
+		}
+		
+		if _, err := c.conn.Write(initData); err != nil {
+			return nil, fmt.Errorf("failed to send handshake init: %w", err)
+		}
+		
+		// Receive handshake response
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			// The server stays silent towards clients that do not know its key,
+			// are not registered as peers or use the wrong pre-shared key.
+			// Servers that only speak version 1 cannot unmask the init.
+			return nil, fmt.Errorf("no handshake response (check server public key, peer registration and pre-shared key; version 1 servers need the legacy handshake): %w", err)
+		}
+		if c.handshakes != nil {
+			if err := c.handshakes.Unprotect(buf[:n], protocol.HeaderSize); err != nil {
+				return nil, fmt.Errorf("failed to unmask response: %w", err)
+			}
+		}
+		
+		// Parse response packet
+		respPacket, err := protocol.UnmarshalPacket(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse response: %w", err)
+		}
+		
+		if respPacket.Header.Type != protocol.PacketTypeCookieReply {
+			return respPacket, nil
+		}
+		
+		// Server is under load, retry with its cookie
+		reply, err := protocol.UnmarshalCookieReply(respPacket.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cookie reply: %w", err)
+		}
+		if err := c.cookies.ConsumeReply(reply.Nonce, reply.EncryptedCookie); err != nil {
+			return nil, err
+		}
+		log.Printf("Server is under load, retrying handshake with cookie")
+	}
+	
+	return nil, errors.New("handshake failed: too many cookie replies")
+}
+
+// tunReadLoop reads from TUN and sends to server until ctx is cancelled
+func (c *Client) tunReadLoop(ctx context.Context) {
 	defer c.wg.Done()
 	
-	buf := make([]byte, 2048)
+	// Packets to compress are read after room for the compression header
+	compressor := c.compressor
+	offset := packetHeadroom
+	if compressor != nil {
+		offset += protocol.CompressionHeaderSize
+	}
+	bufferSize := offset + c.tunDevice.MTU()
 	
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 		
-		n, err := c.tunDevice.Read(buf)
+		buf := protocol.GetBufferFor(bufferSize)
+		n, err := c.tunDevice.Read((*buf)[offset:])
 		if err != nil {
-			if c.ctx.Err() != nil {
+			protocol.PutBuffer(buf)
+			if ctx.Err() != nil {
 				return
 			}
 			log.Printf("TUN read error: %v", err)
 			continue
 		}
 		
-		// Encrypt data
-		ciphertext, err := c.cryptoSession.Encrypt(buf[:n])
+		// Compress, pad and encrypt data
+		ipPacket := (*buf)[offset : offset+n]
+		if compressor != nil {
+			ipPacket = compressor.Compress((*buf)[packetHeadroom : offset+n])
+		}
+		if c.capabilities&protocol.CapabilityPadding != 0 {
+			ipPacket = c.padding.AppendPadding(ipPacket)
+		}
+		
+		// Packets too large for the transport go out as fragments, after
+		// anything batched before them
+		if protocol.HeaderSize+c.keyring.Overhead()+len(ipPacket) > c.maxPacketSize {
+			if c.batcher != nil {
+				c.batcher.Flush()
+			}
+			err = c.writeFragments(ipPacket)
+			protocol.PutBuffer(buf)
+			if err != nil {
+				log.Printf("Dropped packet: %v", err)
+			}
+			c.maybeRekey()
+			continue
+		}
+		
+		if c.batcher != nil {
+			// Sent at once after a quiet spell, otherwise batched until
+			// full or protocol.BatchDelay has passed
+			err = c.batcher.Add(ipPacket)
+			protocol.PutBuffer(buf)
+			if err != nil {
+				log.Printf("Send error: %v", err)
+				c.handleDisconnect()
+				return
+			}
+			c.maybeRekey()
+			continue
+		}
+		
+		data, err := protocol.AppendSealedPacket((*buf)[:0], c.keyring, c.version, protocol.PacketTypeData, c.sessionID, ipPacket)
 		if err != nil {
+			protocol.PutBuffer(buf)
 			log.Printf("Encrypt error: %v", err)
 			continue
 		}
 		
 		// Send to server
-		packet := protocol.NewPacket(protocol.PacketTypeData, c.sessionID, ciphertext)
-		if _, err := c.conn.Write(packet.Marshal()); err != nil {
+		err = c.write(data)
+		protocol.PutBuffer(buf)
+		if err != nil {
 			log.Printf("Send error: %v", err)
 			c.handleDisconnect()
 			return
 		}
+		
+		c.maybeRekey()
 	}
 }
 
-// receiveLoop receives packets from server
-func (c *Client) receiveLoop() {
-	defer c.wg.Done()
+// handleData writes the IP packet in a data payload to the TUN device
+func (c *Client) handleData(payload []byte) {
+	if c.capabilities&protocol.CapabilityPadding != 0 {
+		var err error
+		if payload, err = protocol.StripPadding(payload); err != nil {
+			log.Printf("Dropped data packet: %v", err)
+			return
+		}
+	}
+	if c.decompressor != nil {
+		var err error
+		if payload, err = c.decompressor.Decompress(payload); err != nil {
+			log.Printf("Dropped data packet: %v", err)
+			return
+		}
+	}
 	
-	buf := make([]byte, 4096)
+	// Write to TUN
+	if c.tunDevice != nil {
+		if _, err := c.tunDevice.Write(payload); err != nil {
+			log.Printf("TUN write error: %v", err)
+		}
+	}
+}
+
+// receiveLoop receives packets from server until ctx is cancelled
+func (c *Client) receiveLoop(ctx context.Context) {
+	defer c.wg.Done()
 	
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
 		
-		n, err := c.conn.Read(buf)
+		buf := protocol.GetBuffer()
+		n, err := c.conn.Read(*buf)
 		if err != nil {
-			if c.ctx.Err() != nil {
+			protocol.PutBuffer(buf)
+			if ctx.Err() != nil {
 				return
 			}
 			log.Printf("Receive error: %v", err)
@@ -301,48 +744,178 @@ func (c *Client) receiveLoop() {
 			return
 		}
 		
-		packet, err := protocol.UnmarshalPacket(buf[:n])
-		if err != nil {
-			log.Printf("Parse error: %v", err)
+		if err := c.unprotect((*buf)[:n]); err != nil {
+			protocol.PutBuffer(buf)
+			log.Printf("Dropped packet: %v", err)
 			continue
 		}
-		
-		switch packet.Header.Type {
-		case protocol.PacketTypeData:
-			// Decrypt and write to TUN
-			plaintext, err := c.cryptoSession.Decrypt(packet.Payload)
-			if err != nil {
-				log.Printf("Decrypt error: %v", err)
-				continue
-			}
-			
-			if c.tunDevice != nil {
-				if _, err := c.tunDevice.Write(plaintext); err != nil {
-					log.Printf("TUN write error: %v", err)
-				}
-			}
-			
-		case protocol.PacketTypeKeepAlive:
-			// Server acknowledged keepalive
-			
-		case protocol.PacketTypeDisconnect:
-			log.Println("Server disconnected")
+		done := c.handlePacket((*buf)[:n])
+		protocol.PutBuffer(buf)
+		if done {
 			c.handleDisconnect()
 			return
 		}
 	}
 }
 
-// keepaliveLoop sends periodic keepalive packets
-func (c *Client) keepaliveLoop() {
+// handlePacket processes one packet from the server, decrypting it in
+// place, and reports whether the server has disconnected. Header
+// protection must already be removed.
+func (c *Client) handlePacket(data []byte) bool {
+	var packet protocol.Packet
+	if err := protocol.UnmarshalPacketInto(&packet, data); err != nil {
+		log.Printf("Parse error: %v", err)
+		return false
+	}
+	if packet.Header.Version != c.version {
+		log.Printf("Dropped packet of type %d: version %d", packet.Header.Type, packet.Header.Version)
+		return false
+	}
+	if len(packet.Payload) < crypto.PrefixSize {
+		log.Printf("Dropped packet of type %d: %v", packet.Header.Type, crypto.ErrCiphertextTooShort)
+		return false
+	}
+	
+	// Drop anything that is not authenticated under our session keys,
+	// including forged keepalives and disconnects
+	plaintext, err := protocol.OpenPacketAppend(packet.Payload[crypto.PrefixSize:crypto.PrefixSize], c.keyring, &packet)
+	if err != nil {
+		log.Printf("Dropped packet of type %d: %v", packet.Header.Type, err)
+		return false
+	}
+	
+	switch packet.Header.Type {
+	case protocol.PacketTypeData:
+		c.handleData(plaintext)
+		
+	case protocol.PacketTypeBatch:
+		if c.capabilities&protocol.CapabilityBatching == 0 {
+			log.Printf("Dropped batch: batching not negotiated")
+			return false
+		}
+		entries, err := protocol.UnmarshalBatch(plaintext)
+		if err != nil {
+			log.Printf("Dropped batch: %v", err)
+			return false
+		}
+		for _, entry := range entries {
+			c.handleData(entry)
+		}
+		
+	case protocol.PacketTypeFragment:
+		if c.capabilities&protocol.CapabilityFragmentation == 0 {
+			log.Printf("Dropped fragment: fragmentation not negotiated")
+			return false
+		}
+		payload, err := c.reassembler.Add(plaintext)
+		if err != nil {
+			log.Printf("Dropped fragment: %v", err)
+			return false
+		}
+		if payload != nil {
+			c.handleData(payload)
+		}
+		
+	case protocol.PacketTypeKeepAlive:
+		// Server acknowledged keepalive
+		
+	case protocol.PacketTypePing:
+		// Answer the server's ping with the same message
+		ping, err := protocol.UnmarshalPingMessage(plaintext)
+		if err != nil {
+			log.Printf("Dropped ping: %v", err)
+			return false
+		}
+		pong, err := protocol.SealPacket(c.keyring, c.version, protocol.PacketTypePong, c.sessionID, protocol.MarshalPingMessage(ping))
+		if err != nil {
+			log.Printf("Pong error: %v", err)
+			return false
+		}
+		c.writePacket(pong)
+		
+	case protocol.PacketTypePong:
+		pong, err := protocol.UnmarshalPingMessage(plaintext)
+		if err != nil {
+			log.Printf("Dropped pong: %v", err)
+			return false
+		}
+		c.link.HandlePong(pong)
+		
+	case protocol.PacketTypeRekey:
+		c.handleRekey(plaintext)
+		
+	case protocol.PacketTypeTicket:
+		// Keep a copy, the packet buffer is reused
+		c.connMu.Lock()
+		c.ticket = append([]byte(nil), plaintext...)
+		c.connMu.Unlock()
+		
+	case protocol.PacketTypeDisconnect:
+		msg, err := protocol.UnmarshalDisconnectMessage(plaintext)
+		if err != nil {
+			log.Printf("Server disconnected: %v", err)
+			msg = &protocol.DisconnectMessage{Reason: protocol.DisconnectNormal}
+		} else {
+			log.Printf("Server disconnected: %s", msg)
+		}
+		c.connMu.Lock()
+		c.disconnect = msg
+		c.connMu.Unlock()
+		
+		// Acknowledge, so the server need not wait for the connection to time out
+		if ack, err := protocol.SealPacket(c.keyring, c.version, protocol.PacketTypeDisconnect, c.sessionID, protocol.MarshalDisconnectMessage(&protocol.DisconnectMessage{Reason: protocol.DisconnectNormal})); err == nil {
+			c.writePacket(ack)
+		}
+		return true
+	}
+	
+	return false
+}
+
+// defaultNetwork returns the network settings used when the server pushes none
+func defaultNetwork() *protocol.ClientConfig {
+	return &protocol.ClientConfig{
+		DNS:       []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("8.8.8.8")},
+		MTU:       1400,
+		KeepAlive: protocol.KeepAliveInterval,
+	}
+}
+
+// mergeNetwork overrides the settings in network that the server pushed.
+// A dual-stack tunnel needs an MTU that IPv6 can use.
+func mergeNetwork(network, pushed *protocol.ClientConfig, dualStack bool) error {
+	if len(pushed.DNS) > 0 {
+		network.DNS = pushed.DNS
+	}
+	if len(pushed.SearchDomains) > 0 {
+		network.SearchDomains = pushed.SearchDomains
+	}
+	if len(pushed.Routes) > 0 {
+		network.Routes = pushed.Routes
+	}
+	if pushed.MTU != 0 {
+		if dualStack && pushed.MTU < protocol.MinMTU6 {
+			return fmt.Errorf("pushed MTU %d is below the IPv6 minimum of %d", pushed.MTU, protocol.MinMTU6)
+		}
+		network.MTU = pushed.MTU
+	}
+	if pushed.KeepAlive > 0 {
+		network.KeepAlive = pushed.KeepAlive
+	}
+	return nil
+}
+
+// keepaliveLoop sends a keepalive packet every interval until ctx is
+// cancelled
+func (c *Client) keepaliveLoop(ctx context.Context, interval time.Duration) {
 	defer c.wg.Done()
 	
-	ticker := time.NewTicker(protocol.KeepAliveInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		case <-ticker.C:
 			c.connMu.RLock()
@@ -352,14 +925,153 @@ func (c *Client) keepaliveLoop() {
 			}
 			c.connMu.RUnlock()
 			
-			packet := protocol.NewPacket(protocol.PacketTypeKeepAlive, c.sessionID, nil)
-			if _, err := c.conn.Write(packet.Marshal()); err != nil {
+			// Pings double as keepalives and measure the link
+			var packet *protocol.Packet
+			var err error
+			if c.capabilities&protocol.CapabilityPing != 0 {
+				packet, err = protocol.SealPacket(c.keyring, c.version, protocol.PacketTypePing, c.sessionID, protocol.MarshalPingMessage(c.link.NextPing()))
+			} else {
+				packet, err = protocol.SealPacket(c.keyring, c.version, protocol.PacketTypeKeepAlive, c.sessionID, nil)
+			}
+			if err != nil {
+				log.Printf("Keepalive error: %v", err)
+				continue
+			}
+			if err := c.writePacket(packet); err != nil {
 				log.Printf("Keepalive error: %v", err)
 			}
+			
+			c.maybeRekey()
 		}
 	}
 }
 
+// writePacket sends a packet to the server, serializing concurrent writers
+func (c *Client) writePacket(packet *protocol.Packet) error {
+	return c.write(packet.Marshal())
+}
+
+// writeSealed seals buf[packetHeadroom:] in place and sends it as a packet
+// of the given type
+func (c *Client) writeSealed(buf []byte, packetType uint8) error {
+	data, err := protocol.AppendSealedPacket(buf[:0], c.keyring, c.version, packetType, c.sessionID, buf[packetHeadroom:])
+	if err != nil {
+		return err
+	}
+	return c.write(data)
+}
+
+// writeFragments sends a data payload that does not fit in one packet as
+// a series of fragments
+func (c *Client) writeFragments(payload []byte) error {
+	if c.capabilities&protocol.CapabilityFragmentation == 0 {
+		return fmt.Errorf("%d byte packet too large for the transport", len(payload))
+	}
+	
+	size := c.maxPacketSize - protocol.HeaderSize - c.keyring.Overhead()
+	fragments, err := protocol.Fragment(c.fragmentID.Add(1), payload, size)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		packet, err := protocol.SealPacket(c.keyring, c.version, protocol.PacketTypeFragment, c.sessionID, fragment)
+		if err != nil {
+			return err
+		}
+		if err := c.writePacket(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write sends an already serialized packet to the server, masking its
+// header if the session protects headers. data is modified in place.
+func (c *Client) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.headers != nil {
+		if err := c.headers.Protect(data, packetHeadroom); err != nil {
+			return err
+		}
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// unprotect removes header protection from a received packet in place
+func (c *Client) unprotect(data []byte) error {
+	if c.headers == nil {
+		return nil
+	}
+	return c.headers.Unprotect(data, packetHeadroom)
+}
+
+// maybeRekey starts a rekey when the current keys are due for rotation
+func (c *Client) maybeRekey() {
+	if !c.keyring.NeedsRekey(c.config.RekeyAfterTime, c.config.RekeyAfterBytes) {
+		return
+	}
+	
+	epoch, ephemeral, err := c.keyring.StartRekey()
+	if err != nil {
+		log.Printf("Rekey error: %v", err)
+		return
+	}
+	
+	msg := &protocol.RekeyMessage{Kind: protocol.RekeyInit, Epoch: epoch, EphemeralPublicKey: ephemeral}
+	if err := c.sendRekey(msg); err != nil {
+		log.Printf("Rekey send error: %v", err)
+	}
+}
+
+// sendRekey encrypts and sends a rekey message
+func (c *Client) sendRekey(msg *protocol.RekeyMessage) error {
+	packet, err := protocol.SealPacket(c.keyring, c.version, protocol.PacketTypeRekey, c.sessionID, protocol.MarshalRekeyMessage(msg))
+	if err != nil {
+		return err
+	}
+	return c.writePacket(packet)
+}
+
+// handleRekey processes a decrypted rekey message from the server
+func (c *Client) handleRekey(plaintext []byte) {
+	msg, err := protocol.UnmarshalRekeyMessage(plaintext)
+	if err != nil {
+		log.Printf("Rekey parse error: %v", err)
+		return
+	}
+	
+	switch msg.Kind {
+	case protocol.RekeyInit:
+		ephemeral, err := c.keyring.HandleRekeyInit(msg.Epoch, msg.EphemeralPublicKey)
+		if err != nil {
+			log.Printf("Rekey error: %v", err)
+			return
+		}
+		resp := &protocol.RekeyMessage{Kind: protocol.RekeyResponse, Epoch: msg.Epoch, EphemeralPublicKey: ephemeral}
+		if err := c.sendRekey(resp); err != nil {
+			log.Printf("Rekey send error: %v", err)
+		}
+		
+	case protocol.RekeyResponse:
+		if err := c.keyring.HandleRekeyResponse(msg.Epoch, msg.EphemeralPublicKey); err != nil {
+			log.Printf("Rekey error: %v", err)
+			return
+		}
+		// Sent under the new keys, which lets the server switch as well
+		confirm := &protocol.RekeyMessage{Kind: protocol.RekeyConfirm, Epoch: msg.Epoch}
+		if err := c.sendRekey(confirm); err != nil {
+			log.Printf("Rekey send error: %v", err)
+		}
+		log.Printf("Rekeyed session %d to epoch %d", c.sessionID, msg.Epoch)
+		
+	case protocol.RekeyConfirm:
+		// Decrypting the confirmation already switched to the new keys
+		log.Printf("Rekeyed session %d to epoch %d", c.sessionID, msg.Epoch)
+	}
+}
+
 // handleDisconnect handles connection loss
 func (c *Client) handleDisconnect() {
 	c.connMu.Lock()
@@ -370,6 +1082,7 @@ func (c *Client) handleDisconnect() {
 	c.connected = false
 	c.connMu.Unlock()
 	
+	c.closeConnection()
 	log.Println("Disconnected from server")
 	
 	if c.config.AutoReconnect {
@@ -377,8 +1090,42 @@ func (c *Client) handleDisconnect() {
 	}
 }
 
-// reconnectLoop attempts to reconnect
+// closeConnection stops the loops of the current connection and closes
+// its transport connection and TUN device, which unblocks their reads.
+// It does nothing if the connection is already closed.
+func (c *Client) closeConnection() {
+	c.connMu.Lock()
+	cancel := c.connCancel
+	c.connCancel = nil
+	c.connMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	
+	cancel()
+	if c.batcher != nil {
+		c.batcher.Stop()
+	}
+	c.conn.Close()
+	if c.tunDevice != nil {
+		c.tunDevice.Close()
+	}
+}
+
+// reconnectLoop attempts to reconnect. It waits at least as long as the
+// server asked in its last disconnect, and gives up if the server rejected
+// our key.
 func (c *Client) reconnectLoop() {
+	c.connMu.Lock()
+	msg := c.disconnect
+	c.disconnect = nil
+	c.connMu.Unlock()
+	
+	// The loops of the old connection must be gone before Connect replaces
+	// the session state they use
+	c.wg.Wait()
+	c.tunDevice = nil
+	
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -386,16 +1133,40 @@ func (c *Client) reconnectLoop() {
 		default:
 		}
 		
-		log.Printf("Attempting to reconnect in %v...", c.config.ReconnectDelay)
-		time.Sleep(c.config.ReconnectDelay)
+		delay, ok := c.reconnectDelay(msg)
+		if !ok {
+			log.Printf("Not reconnecting: %s", msg)
+			return
+		}
 		
-		if err := c.Connect(); err != nil {
-			log.Printf("Reconnect failed: %v", err)
-			continue
+		log.Printf("Attempting to reconnect in %v...", delay)
+		time.Sleep(delay)
+		
+		err := c.Connect()
+		if err == nil {
+			return
 		}
+		log.Printf("Reconnect failed: %v", err)
 		
-		return
+		msg = nil
+		var refused *DisconnectError
+		if errors.As(err, &refused) {
+			msg = &refused.Message
+		}
+	}
+}
+
+// reconnectDelay returns how long to wait before reconnecting after the
+// server's last disconnect message, which may be nil, and false if the
+// client must not reconnect at all
+func (c *Client) reconnectDelay(msg *protocol.DisconnectMessage) (time.Duration, bool) {
+	if msg == nil {
+		return c.config.ReconnectDelay, true
+	}
+	if msg.Permanent() {
+		return 0, false
 	}
+	return max(c.config.ReconnectDelay, msg.RetryAfter), true
 }
 
 // Disconnect disconnects from the server
@@ -408,18 +1179,29 @@ func (c *Client) Disconnect() error {
 	
 	// Send disconnect packet
 	if c.conn != nil {
-		packet := protocol.NewPacket(protocol.PacketTypeDisconnect, c.sessionID, nil)
-		c.conn.Write(packet.Marshal())
+		if c.keyring != nil {
+			msg := protocol.MarshalDisconnectMessage(&protocol.DisconnectMessage{Reason: protocol.DisconnectNormal})
+			if packet, err := protocol.SealPacket(c.keyring, c.version, protocol.PacketTypeDisconnect, c.sessionID, msg); err == nil {
+				c.writePacket(packet)
+			}
+		}
 		c.conn.Close()
 	}
 	
 	c.cancel()
+	c.closeConnection()
 	
-	if c.tunDevice != nil {
-		c.tunDevice.Close()
+	c.wg.Wait()
+	if c.batcher != nil {
+		c.batcher.Stop()
 	}
 	
-	c.wg.Wait()
+	// Nothing can use the keys any more
+	if c.keyring != nil {
+		c.keyring.Destroy()
+	}
+	c.keyPair.Destroy()
+	
 	log.Println("Disconnected")
 	return nil
 }
@@ -431,7 +1213,49 @@ func (c *Client) IsConnected() bool {
 	return c.connected
 }
 
+// PublicKey returns the client's static public key
+func (c *Client) PublicKey() [32]byte {
+	return c.keyPair.PublicKey
+}
+
 // AssignedIP returns the assigned VPN IP
 func (c *Client) AssignedIP() net.IP {
 	return c.assignedIP
 }
+
+// AssignedIP6 returns the assigned VPN IPv6 address, nil on IPv4-only sessions
+func (c *Client) AssignedIP6() net.IP {
+	return c.assignedIP6
+}
+
+// LinkStats returns the round trip time, jitter and loss measured with
+// pings to the server. They stay zero if the server does not do pings.
+func (c *Client) LinkStats() protocol.LinkStats {
+	return c.link.Stats()
+}
+
+// CompressionStats returns how well data packets to and from the server
+// compressed. They stay zero if the session does not compress.
+func (c *Client) CompressionStats() (sent, received protocol.CompressionStats) {
+	if c.compressor == nil {
+		return sent, received
+	}
+	return c.compressor.Stats(), c.decompressor.Stats()
+}
+
+// maxVersion returns the newest protocol version the client speaks
+func (c *Client) maxVersion() uint8 {
+	if c.config.LegacyHandshake {
+		return protocol.LegacyHandshakeVersion
+	}
+	return protocol.ProtocolVersion
+}
+
+// offeredCapabilities returns the capability flags offered to the server
+func (c *Client) offeredCapabilities() uint32 {
+	var capabilities uint32 = protocol.SupportedCapabilities
+	if !c.config.Compression {
+		capabilities &^= protocol.CapabilityCompression
+	}
+	return capabilities
+}
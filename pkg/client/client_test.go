@@ -0,0 +1,251 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hydravpn/hydra/pkg/protocol"
+	"github.com/hydravpn/hydra/pkg/server"
+	"github.com/hydravpn/hydra/pkg/transport"
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, route, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return route
+}
+
+func TestMergeNetwork(t *testing.T) {
+	defaults := defaultNetwork()
+	tests := []struct {
+		name      string
+		pushed    *protocol.ClientConfig
+		dualStack bool
+		want      *protocol.ClientConfig
+		wantErr   bool
+	}{
+		{
+			name:   "nothing pushed keeps the defaults",
+			pushed: &protocol.ClientConfig{},
+			want:   defaultNetwork(),
+		},
+		{
+			name: "pushed settings replace the defaults",
+			pushed: &protocol.ClientConfig{
+				DNS:           []net.IP{net.ParseIP("10.8.0.1")},
+				SearchDomains: []string{"corp.example"},
+				Routes:        []*net.IPNet{mustParseCIDR("10.0.0.0/8")},
+				MTU:           1380,
+				KeepAlive:     10 * time.Second,
+			},
+			want: &protocol.ClientConfig{
+				DNS:           []net.IP{net.ParseIP("10.8.0.1")},
+				SearchDomains: []string{"corp.example"},
+				Routes:        []*net.IPNet{mustParseCIDR("10.0.0.0/8")},
+				MTU:           1380,
+				KeepAlive:     10 * time.Second,
+			},
+		},
+		{
+			name:   "lists are replaced, not appended",
+			pushed: &protocol.ClientConfig{DNS: []net.IP{net.ParseIP("9.9.9.9")}},
+			want: &protocol.ClientConfig{
+				DNS:       []net.IP{net.ParseIP("9.9.9.9")},
+				MTU:       defaults.MTU,
+				KeepAlive: defaults.KeepAlive,
+			},
+		},
+		{
+			name:   "small MTU on an IPv4-only tunnel",
+			pushed: &protocol.ClientConfig{MTU: protocol.MinMTU},
+			want: &protocol.ClientConfig{
+				DNS:       defaults.DNS,
+				MTU:       protocol.MinMTU,
+				KeepAlive: defaults.KeepAlive,
+			},
+		},
+		{
+			name:      "IPv6 minimum MTU on a dual-stack tunnel",
+			pushed:    &protocol.ClientConfig{MTU: protocol.MinMTU6},
+			dualStack: true,
+			want: &protocol.ClientConfig{
+				DNS:       defaults.DNS,
+				MTU:       protocol.MinMTU6,
+				KeepAlive: defaults.KeepAlive,
+			},
+		},
+		{
+			name:      "MTU too small for a dual-stack tunnel",
+			pushed:    &protocol.ClientConfig{MTU: protocol.MinMTU6 - 1},
+			dualStack: true,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := defaultNetwork()
+			err := mergeNetwork(network, tt.pushed, tt.dualStack)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("merged %+v, want error", network)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(network, tt.want) {
+				t.Fatalf("got %+v, want %+v", network, tt.want)
+			}
+		})
+	}
+}
+
+// startServer runs a server without a TUN device on a loopback port
+func startServer(t *testing.T) *server.Server {
+	t.Helper()
+	cfg := server.DefaultConfig()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.TUNConfig = nil
+	cfg.EnableNAT = false
+	cfg.HandshakeLoadThreshold = 1 << 16
+	srv, err := server.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+	return srv
+}
+
+// newPeer creates a client registered as a peer of srv
+func newPeer(t *testing.T, srv *server.Server, legacy bool) *Client {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.ServerAddr = srv.Addr().String()
+	cfg.ServerPublicKey = srv.PublicKey()
+	cfg.AutoReconnect = false
+	cfg.PostQuantum = false
+	cfg.LegacyHandshake = legacy
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.cancel)
+	srv.Peers().Add(server.Peer{Name: "test", PublicKey: c.PublicKey()})
+	return c
+}
+
+// handshake dials the server and runs the handshake starting at version,
+// without bringing up a TUN device. The connection stays open until the
+// test ends.
+func handshake(t *testing.T, c *Client, version uint8) error {
+	t.Helper()
+	conn, err := c.transport.Dial(c.ctx, c.config.ServerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c.writeMu.Lock()
+	c.conn = conn
+	c.writeMu.Unlock()
+	c.maxPacketSize = transport.MessageLimit(conn, protocol.BufferSize)
+	c.reassembler = protocol.NewReassembler()
+	return c.performHandshake(version)
+}
+
+func TestHandshake(t *testing.T) {
+	srv := startServer(t)
+	tests := []struct {
+		name    string
+		legacy  bool
+		version uint8
+		want    uint8
+	}{
+		{name: "current version", version: protocol.ProtocolVersion, want: protocol.ProtocolVersion},
+		{name: "legacy handshake", legacy: true, version: protocol.LegacyHandshakeVersion, want: protocol.LegacyHandshakeVersion},
+		{name: "unknown version is negotiated down", version: protocol.ProtocolVersion + 1, want: protocol.ProtocolVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPeer(t, srv, tt.legacy)
+			if err := handshake(t, c, tt.version); err != nil {
+				t.Fatal(err)
+			}
+			if c.version != tt.want {
+				t.Fatalf("version = %d, want %d", c.version, tt.want)
+			}
+			if c.assignedIP.IsUnspecified() {
+				t.Fatal("no address assigned")
+			}
+		})
+	}
+}
+
+func TestHandshakeRefusedWhenPoolExhausted(t *testing.T) {
+	srv := startServer(t)
+
+	// Hold every address of the pool
+	for i := 0; ; i++ {
+		c := newPeer(t, srv, false)
+		err := handshake(t, c, protocol.ProtocolVersion)
+		if err == nil {
+			continue
+		}
+		var refused *DisconnectError
+		if !errors.As(err, &refused) {
+			t.Fatalf("handshake %d: %v", i, err)
+		}
+		if refused.Message.Reason != protocol.DisconnectPoolExhausted {
+			t.Fatalf("refused with %s, want pool exhausted", &refused.Message)
+		}
+		if refused.Message.RetryAfter <= 0 {
+			t.Fatal("refusal carries no retry hint")
+		}
+		if delay, ok := c.reconnectDelay(&refused.Message); !ok || delay < refused.Message.RetryAfter {
+			t.Fatalf("reconnect delay = %v, %v; want at least %v", delay, ok, refused.Message.RetryAfter)
+		}
+
+		// The refused session holds no place in the session table
+		stats := srv.SessionStats()
+		if len(stats) != i {
+			t.Fatalf("%d sessions after %d handshakes, want %d", len(stats), i+1, i)
+		}
+		for _, session := range stats {
+			if session.AssignedIP == nil {
+				t.Fatalf("session %d has no address", session.ID)
+			}
+		}
+		return
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	c := &Client{config: &Config{ReconnectDelay: 5 * time.Second}}
+	tests := []struct {
+		name string
+		msg  *protocol.DisconnectMessage
+		want time.Duration
+		ok   bool
+	}{
+		{name: "no message", want: 5 * time.Second, ok: true},
+		{name: "shorter hint", msg: &protocol.DisconnectMessage{Reason: protocol.DisconnectShutdown, RetryAfter: time.Second}, want: 5 * time.Second, ok: true},
+		{name: "longer hint", msg: &protocol.DisconnectMessage{Reason: protocol.DisconnectPoolExhausted, RetryAfter: time.Minute}, want: time.Minute, ok: true},
+		{name: "key rejected", msg: &protocol.DisconnectMessage{Reason: protocol.DisconnectKeyRejected}, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := c.reconnectDelay(tt.msg)
+			if ok != tt.ok || delay != tt.want {
+				t.Fatalf("got %v, %v; want %v, %v", delay, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
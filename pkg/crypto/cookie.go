@@ -0,0 +1,187 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cookie constants
+const (
+	// MACSize is the size of each MAC appended to a handshake init
+	MACSize = blake2s.Size128
+
+	// CookieSize is the size of a cookie handed out under load
+	CookieSize = blake2s.Size128
+
+	// EncryptedCookieSize is a sealed cookie: cookie + tag
+	EncryptedCookieSize = CookieSize + TagSize
+
+	// CookieNonceSize is the size of the random nonce in a cookie reply
+	CookieNonceSize = chacha20poly1305.NonceSizeX
+
+	// CookieRefreshTime is how often the server rotates its cookie secret,
+	// and how long a client may keep using a cookie
+	CookieRefreshTime = 2 * time.Minute
+
+	cookieLabelMAC1   = "mac1----"
+	cookieLabelCookie = "cookie--"
+)
+
+// ErrInvalidCookieReply is returned when a cookie reply cannot be opened
+var ErrInvalidCookieReply = errors.New("invalid cookie reply")
+
+// deriveCookieKeys derives the MAC1 and cookie encryption keys from the
+// server's public key, so only clients that know it can produce them
+func deriveCookieKeys(serverPublicKey [32]byte) (mac1Key, cookieKey [32]byte) {
+	mac1Key = sha256.Sum256(append([]byte(cookieLabelMAC1), serverPublicKey[:]...))
+	cookieKey = sha256.Sum256(append([]byte(cookieLabelCookie), serverPublicKey[:]...))
+	return
+}
+
+// mac computes a 128-bit keyed BLAKE2s MAC over data
+func mac(key, data []byte) [MACSize]byte {
+	var out [MACSize]byte
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+	h.Sum(out[:0])
+	return out
+}
+
+// CookieChecker validates the MACs on incoming handshake inits and issues
+// cookies bound to the client's source address when the server is busy
+type CookieChecker struct {
+	mac1Key      [32]byte
+	cookieKey    [32]byte
+	mu           sync.Mutex
+	secret       [32]byte
+	secretExpiry time.Time
+}
+
+// NewCookieChecker creates a checker for the given server public key
+func NewCookieChecker(serverPublicKey [32]byte) *CookieChecker {
+	c := &CookieChecker{}
+	c.mac1Key, c.cookieKey = deriveCookieKeys(serverPublicKey)
+	return c
+}
+
+// CheckMAC1 verifies the first MAC of a marshaled handshake init, which
+// proves the sender knows the server public key
+func (c *CookieChecker) CheckMAC1(msg []byte) bool {
+	if len(msg) < 2*MACSize {
+		return false
+	}
+	macOffset := len(msg) - 2*MACSize
+	expected := mac(c.mac1Key[:], msg[:macOffset])
+	return hmac.Equal(expected[:], msg[macOffset:macOffset+MACSize])
+}
+
+// CheckMAC2 verifies the second MAC, which proves the sender recently
+// received a cookie for the given source address
+func (c *CookieChecker) CheckMAC2(msg []byte, src []byte) bool {
+	if len(msg) < 2*MACSize {
+		return false
+	}
+	cookie := c.cookie(src)
+	macOffset := len(msg) - MACSize
+	expected := mac(cookie[:], msg[:macOffset])
+	return hmac.Equal(expected[:], msg[macOffset:])
+}
+
+// CreateReply seals a cookie for src, bound to the MAC1 of msg
+func (c *CookieChecker) CreateReply(msg []byte, src []byte) (nonce [CookieNonceSize]byte, encryptedCookie [EncryptedCookieSize]byte, err error) {
+	if len(msg) < 2*MACSize {
+		err = errors.New("message too short")
+		return
+	}
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return
+	}
+
+	cookie := c.cookie(src)
+	aead, err := chacha20poly1305.NewX(c.cookieKey[:])
+	if err != nil {
+		return
+	}
+	macOffset := len(msg) - 2*MACSize
+	aead.Seal(encryptedCookie[:0], nonce[:], cookie[:], msg[macOffset:macOffset+MACSize])
+	return
+}
+
+// cookie computes the current cookie for a source address
+func (c *CookieChecker) cookie(src []byte) [CookieSize]byte {
+	c.mu.Lock()
+	if time.Now().After(c.secretExpiry) {
+		rand.Read(c.secret[:])
+		c.secretExpiry = time.Now().Add(CookieRefreshTime)
+	}
+	secret := c.secret
+	c.mu.Unlock()
+
+	return mac(secret[:], src)
+}
+
+// CookieGenerator appends MACs to outgoing handshake inits and remembers
+// the last cookie received from the server
+type CookieGenerator struct {
+	mac1Key    [32]byte
+	cookieKey  [32]byte
+	mu         sync.Mutex
+	cookie     [CookieSize]byte
+	cookieTime time.Time
+	lastMAC1   [MACSize]byte
+}
+
+// NewCookieGenerator creates a generator for the given server public key
+func NewCookieGenerator(serverPublicKey [32]byte) *CookieGenerator {
+	g := &CookieGenerator{}
+	g.mac1Key, g.cookieKey = deriveCookieKeys(serverPublicKey)
+	return g
+}
+
+// AddMACs fills in the two MAC fields at the end of a marshaled handshake
+// init. MAC2 is left zero unless a fresh cookie is available.
+func (g *CookieGenerator) AddMACs(msg []byte) {
+	macOffset := len(msg) - 2*MACSize
+	mac1 := mac(g.mac1Key[:], msg[:macOffset])
+	copy(msg[macOffset:], mac1[:])
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.lastMAC1 = mac1
+
+	mac2 := msg[macOffset+MACSize:]
+	if g.cookieTime.IsZero() || time.Since(g.cookieTime) >= CookieRefreshTime {
+		for i := range mac2 {
+			mac2[i] = 0
+		}
+		return
+	}
+	sum := mac(g.cookie[:], msg[:macOffset+MACSize])
+	copy(mac2, sum[:])
+}
+
+// ConsumeReply decrypts a cookie reply to the last sent handshake init
+func (g *CookieGenerator) ConsumeReply(nonce [CookieNonceSize]byte, encryptedCookie [EncryptedCookieSize]byte) error {
+	aead, err := chacha20poly1305.NewX(g.cookieKey[:])
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var cookie [CookieSize]byte
+	if _, err := aead.Open(cookie[:0], nonce[:], encryptedCookie[:], g.lastMAC1[:]); err != nil {
+		return ErrInvalidCookieReply
+	}
+	g.cookie = cookie
+	g.cookieTime = time.Now()
+	return nil
+}
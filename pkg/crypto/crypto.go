@@ -7,6 +7,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
@@ -19,34 +23,73 @@ type KeyPair struct {
 	PublicKey  [32]byte
 }
 
-// Session holds the encryption state for a VPN session
+// CounterSize is the size of the explicit nonce counter preceding each ciphertext
+const CounterSize = 8
+
+// Decryption errors
+var (
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	ErrReplayedPacket     = errors.New("replayed or too old packet")
+	ErrNonceExhausted     = errors.New("nonce counter exhausted")
+	ErrSessionDestroyed   = errors.New("session keys destroyed")
+)
+
+// Session holds the encryption state for a VPN session.
+// The derived keys are wiped once the AEADs are set up, but each AEAD
+// keeps a private copy (the key or the AES key schedule) that Go offers no
+// way to clear. Destroy can only drop the AEADs and leave that memory to
+// the garbage collector.
+// Seal and open calls run concurrently: each reserves its nonce counter
+// atomically and builds the nonce in a buffer of its own.
 type Session struct {
-	SendKey    [32]byte
-	RecvKey    [32]byte
-	SendNonce  uint64
-	RecvNonce  uint64
-	sendCipher cipher.AEAD
-	recvCipher cipher.AEAD
+	sendCounter atomic.Uint64 // Next counter to send
+	replay      ReplayFilter
+	sendCipher  atomic.Pointer[sessionCipher] // Nil once destroyed
+	recvCipher  atomic.Pointer[sessionCipher] // Nil once destroyed
+	suite       CipherSuite
+	epoch       uint8         // Key generation, assigned by Keyring
+	created     time.Time     // When the keys were derived
+	bytes       atomic.Uint64 // Plaintext bytes sent and received
+}
+
+// noncePool holds nonce buffers. A nonce passed to an AEAD escapes to the
+// heap, so pooling them keeps sealing and opening free of allocations.
+var noncePool = sync.Pool{
+	New: func() any { return new([chacha20poly1305.NonceSizeX]byte) },
+}
+
+// sessionCipher holds the AEAD of one direction, so it can be swapped
+// out atomically
+type sessionCipher struct {
+	aead cipher.AEAD
 }
 
 // GenerateKeyPair generates a new X25519 key pair
 func GenerateKeyPair() (*KeyPair, error) {
-	kp := &KeyPair{}
-
 	// Generate random private key
-	if _, err := io.ReadFull(rand.Reader, kp.PrivateKey[:]); err != nil {
+	var privateKey [32]byte
+	if _, err := io.ReadFull(rand.Reader, privateKey[:]); err != nil {
 		return nil, err
 	}
 
-	// Clamp private key for X25519
-	kp.PrivateKey[0] &= 248
-	kp.PrivateKey[31] &= 127
-	kp.PrivateKey[31] |= 64
+	// Clamp and derive public key
+	kp := NewKeyPair(privateKey)
+	Wipe(privateKey[:])
+	return kp, nil
+}
 
-	// Derive public key
-	curve25519.ScalarBaseMult(&kp.PublicKey, &kp.PrivateKey)
+// Destroy zeroes the private key. The public key stays usable.
+func (kp *KeyPair) Destroy() {
+	if kp != nil {
+		Wipe(kp.PrivateKey[:])
+	}
+}
 
-	return kp, nil
+// Wipe overwrites b with zeros. Key material should be wiped as soon as it
+// is no longer needed rather than left for the garbage collector.
+func Wipe(b []byte) {
+	clear(b)
+	runtime.KeepAlive(b)
 }
 
 // ComputeSharedSecret computes the shared secret using X25519
@@ -64,11 +107,14 @@ func ComputeSharedSecret(privateKey, peerPublicKey [32]byte) ([32]byte, error) {
 }
 
 // DeriveSessionKeys derives send and receive keys from shared secret using HKDF
-func DeriveSessionKeys(sharedSecret [32]byte, isInitiator bool, salt []byte) (*Session, error) {
+// and sets up the AEAD of the negotiated cipher suite
+func DeriveSessionKeys(sharedSecret [32]byte, isInitiator bool, salt []byte, suite CipherSuite) (*Session, error) {
 	// Use HKDF to derive keys
 	hkdfReader := hkdf.New(sha256.New, sharedSecret[:], salt, []byte("hydravpn-session-keys"))
 
 	var key1, key2 [32]byte
+	defer Wipe(key1[:])
+	defer Wipe(key2[:])
 	if _, err := io.ReadFull(hkdfReader, key1[:]); err != nil {
 		return nil, err
 	}
@@ -76,69 +122,141 @@ func DeriveSessionKeys(sharedSecret [32]byte, isInitiator bool, salt []byte) (*S
 		return nil, err
 	}
 
-	session := &Session{}
+	session := &Session{suite: suite, created: time.Now()}
 
 	// Initiator sends with key1, receives with key2
 	// Responder sends with key2, receives with key1
-	if isInitiator {
-		session.SendKey = key1
-		session.RecvKey = key2
-	} else {
-		session.SendKey = key2
-		session.RecvKey = key1
+	sendKey, recvKey := key1[:], key2[:]
+	if !isInitiator {
+		sendKey, recvKey = recvKey, sendKey
 	}
 
-	// Initialize ciphers using XChaCha20-Poly1305
-	var err error
-	session.sendCipher, err = chacha20poly1305.NewX(session.SendKey[:])
+	// Initialize ciphers for the negotiated suite
+	sendCipher, err := suite.newAEAD(sendKey)
 	if err != nil {
 		return nil, err
 	}
+	session.sendCipher.Store(&sessionCipher{aead: sendCipher})
 
-	session.recvCipher, err = chacha20poly1305.NewX(session.RecvKey[:])
+	recvCipher, err := suite.newAEAD(recvKey)
 	if err != nil {
 		return nil, err
 	}
+	session.recvCipher.Store(&sessionCipher{aead: recvCipher})
 
 	return session, nil
 }
 
-// Encrypt encrypts plaintext using XChaCha20-Poly1305
-func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
-	// Create nonce from counter
-	nonce := make([]byte, 24)
-	binary.LittleEndian.PutUint64(nonce, s.SendNonce)
-	s.SendNonce++
+// Overhead returns how much longer a ciphertext is than its plaintext
+func (s *Session) Overhead() int {
+	return CounterSize + TagSize
+}
 
-	// Add random bytes to nonce for extra security
-	if _, err := io.ReadFull(rand.Reader, nonce[8:]); err != nil {
-		return nil, err
+// Encrypt encrypts plaintext with the session's AEAD, authenticating
+// additionalData along with it.
+// The output is the big-endian nonce counter followed by the sealed data.
+func (s *Session) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	return s.SealAppend(make([]byte, 0, s.Overhead()+len(plaintext)), plaintext, additionalData)
+}
+
+// SealAppend is like Encrypt but appends the result to dst, so callers can
+// reuse buffers. plaintext may alias the part of dst's capacity where the
+// sealed data goes, that is dst[len(dst)+CounterSize:], for in-place encryption.
+func (s *Session) SealAppend(dst, plaintext, additionalData []byte) ([]byte, error) {
+	c := s.sendCipher.Load()
+	if c == nil {
+		return nil, ErrSessionDestroyed
+	}
+	counter := s.sendCounter.Add(1) - 1
+	if counter >= RejectAfterMessages {
+		return nil, ErrNonceExhausted
 	}
 
+	var prefix [CounterSize]byte
+	binary.BigEndian.PutUint64(prefix[:], counter)
+	dst = append(dst, prefix[:]...)
+
 	// Encrypt with AEAD
-	ciphertext := s.sendCipher.Seal(nonce, nonce, plaintext, nil)
+	s.bytes.Add(uint64(len(plaintext)))
+
+	nonce := noncePool.Get().(*[chacha20poly1305.NonceSizeX]byte)
+	dst = c.aead.Seal(dst, counterNonce(nonce[:c.aead.NonceSize()], counter), plaintext, additionalData)
+	noncePool.Put(nonce)
+	return dst, nil
+}
 
-	return ciphertext, nil
+// Decrypt decrypts ciphertext with the session's AEAD, rejecting
+// duplicated counters, counters behind the replay window and any change
+// to additionalData
+func (s *Session) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	return s.OpenAppend(nil, ciphertext, additionalData)
 }
 
-// Decrypt decrypts ciphertext using XChaCha20-Poly1305
-func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
-	if len(ciphertext) < 24 {
-		return nil, errors.New("ciphertext too short")
+// OpenAppend is like Decrypt but appends the plaintext to dst. Passing
+// ciphertext[CounterSize:CounterSize] as dst decrypts in place.
+func (s *Session) OpenAppend(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < CounterSize+TagSize {
+		return nil, ErrCiphertextTooShort
 	}
 
-	// Extract nonce
-	nonce := ciphertext[:24]
-	ciphertext = ciphertext[24:]
+	// Extract counter and drop obvious replays before doing any crypto
+	counter := binary.BigEndian.Uint64(ciphertext[:CounterSize])
+	if !s.replay.Check(counter) {
+		return nil, ErrReplayedPacket
+	}
 
 	// Decrypt
-	plaintext, err := s.recvCipher.Open(nil, nonce, ciphertext, nil)
+	c := s.recvCipher.Load()
+	if c == nil {
+		return nil, ErrSessionDestroyed
+	}
+	start := len(dst)
+	nonce := noncePool.Get().(*[chacha20poly1305.NonceSizeX]byte)
+	dst, err := c.aead.Open(dst, counterNonce(nonce[:c.aead.NonceSize()], counter), ciphertext[CounterSize:], additionalData)
+	noncePool.Put(nonce)
 	if err != nil {
 		return nil, err
 	}
 
-	s.RecvNonce++
-	return plaintext, nil
+	// Only authenticated counters move the window
+	if !s.replay.Accept(counter) {
+		return nil, ErrReplayedPacket
+	}
+
+	s.bytes.Add(uint64(len(dst) - start))
+	return dst, nil
+}
+
+// Destroy drops the session's ciphers so its keys become unreachable.
+// The key copies inside them are not zeroed; see Session.
+// Any later Encrypt or Decrypt fails with ErrSessionDestroyed.
+// It is safe to call more than once.
+func (s *Session) Destroy() {
+	s.sendCipher.Store(nil)
+	s.recvCipher.Store(nil)
+}
+
+// Suite returns the cipher suite protecting the session
+func (s *Session) Suite() CipherSuite {
+	return s.suite
+}
+
+// Age returns how long ago the session keys were derived
+func (s *Session) Age() time.Duration {
+	return time.Since(s.created)
+}
+
+// Bytes returns the number of plaintext bytes sent and received
+func (s *Session) Bytes() uint64 {
+	return s.bytes.Load()
+}
+
+// counterNonce fills nonce with zeros followed by the counter in its last
+// 8 bytes. Pooled nonces may hold a counter at another offset.
+func counterNonce(nonce []byte, counter uint64) []byte {
+	clear(nonce[:len(nonce)-8])
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
 }
 
 // GenerateRandomBytes generates cryptographically secure random bytes
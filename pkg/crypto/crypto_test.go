@@ -0,0 +1,156 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testSuites lists every supported cipher suite
+var testSuites = []CipherSuite{CipherSuiteXChaCha20Poly1305, CipherSuiteAES256GCM}
+
+// benchSizes are the plaintext sizes measured by the benchmarks: a small
+// control packet, a full tunnel MTU and a large buffer
+var benchSizes = []int{64, 1400, 8192}
+
+// newSessionPair derives a matching sender and receiver for suite
+func newSessionPair(tb testing.TB, suite CipherSuite) (sender, receiver *Session) {
+	tb.Helper()
+	var secret [32]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		tb.Fatal(err)
+	}
+	sender, err := DeriveSessionKeys(secret, true, nil, suite)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	receiver, err = DeriveSessionKeys(secret, false, nil, suite)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func TestSessionRejectsReplays(t *testing.T) {
+	for _, suite := range testSuites {
+		t.Run(suite.String(), func(t *testing.T) {
+			sender, receiver := newSessionPair(t, suite)
+			header := []byte("header")
+			var ciphertexts [][]byte
+			for i := 0; i < 3; i++ {
+				ciphertext, err := sender.Encrypt([]byte{byte(i)}, header)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ciphertexts = append(ciphertexts, ciphertext)
+			}
+
+			// Reordered packets are fine, repeated ones are not
+			for _, i := range []int{2, 0, 1} {
+				plaintext, err := receiver.Decrypt(ciphertexts[i], header)
+				if err != nil {
+					t.Fatalf("packet %d: %v", i, err)
+				}
+				if !bytes.Equal(plaintext, []byte{byte(i)}) {
+					t.Fatalf("packet %d decrypted to %v", i, plaintext)
+				}
+			}
+			for i := range ciphertexts {
+				if _, err := receiver.Decrypt(ciphertexts[i], header); !errors.Is(err, ErrReplayedPacket) {
+					t.Fatalf("replayed packet %d: err = %v, want ErrReplayedPacket", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionForgeryDoesNotMoveWindow(t *testing.T) {
+	sender, receiver := newSessionPair(t, CipherSuiteAES256GCM)
+	ciphertext, err := sender.Encrypt([]byte("data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forged := bytes.Clone(ciphertext)
+	forged[len(forged)-1] ^= 1
+	if _, err := receiver.Decrypt(forged, nil); err == nil {
+		t.Fatal("forged packet decrypted")
+	}
+	if _, err := receiver.Decrypt(ciphertext, []byte("other header")); err == nil {
+		t.Fatal("packet decrypted under another header")
+	}
+	if _, err := receiver.Decrypt(ciphertext, nil); err != nil {
+		t.Fatalf("genuine packet after forgeries: %v", err)
+	}
+}
+
+func TestSealNonceExhausted(t *testing.T) {
+	sender, receiver := newSessionPair(t, CipherSuiteXChaCha20Poly1305)
+	sender.sendCounter.Store(RejectAfterMessages - 1)
+
+	ciphertext, err := sender.Encrypt([]byte("last"), nil)
+	if err != nil {
+		t.Fatalf("last counter: %v", err)
+	}
+	if _, err := receiver.Decrypt(ciphertext, nil); err != nil {
+		t.Fatalf("last counter: %v", err)
+	}
+	if _, err := sender.Encrypt([]byte("one too many"), nil); !errors.Is(err, ErrNonceExhausted) {
+		t.Fatalf("err = %v, want ErrNonceExhausted", err)
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	for _, suite := range testSuites {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				sender, _ := newSessionPair(b, suite)
+				plaintext := make([]byte, size)
+				header := make([]byte, 14) // A packet header as associated data
+				out := make([]byte, 0, size+sender.Overhead())
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for b.Loop() {
+					if _, err := sender.SealAppend(out[:0], plaintext, header); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, suite := range testSuites {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", suite, size), func(b *testing.B) {
+				sender, receiver := newSessionPair(b, suite)
+				plaintext := make([]byte, size)
+				header := make([]byte, 14) // A packet header as associated data
+
+				// Seal every packet up front so only decryption is timed
+				ciphertexts := make([][]byte, b.N)
+				for i := range ciphertexts {
+					ciphertext, err := sender.Encrypt(plaintext, header)
+					if err != nil {
+						b.Fatal(err)
+					}
+					ciphertexts[i] = ciphertext
+				}
+				out := make([]byte, 0, size)
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := receiver.OpenAppend(out[:0], ciphertexts[i], header); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package crypto
+
+import (
+	"crypto/mlkem"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Handshake constants
+const (
+	// Noise protocol name, hashed to initialize the handshake state
+	handshakeConstruction = "HydraVPN_IK_25519_ChaChaPoly_SHA256"
+
+	// Prologue identifier mixed into the transcript
+	handshakeIdentifier = "HydraVPN v1 handshake"
+
+	// TagSize is the size of an AEAD authentication tag
+	TagSize = chacha20poly1305.Overhead
+
+	// EncryptedStaticSize is the size of a sealed static public key
+	EncryptedStaticSize = 32 + TagSize
+)
+
+// Handshake errors
+var (
+	ErrHandshakeAuth = errors.New("handshake authentication failed")
+	ErrInvalidKEMKey = errors.New("invalid ML-KEM encapsulation key")
+	ErrUnexpectedKEM = errors.New("ML-KEM ciphertext without a key offer")
+)
+
+// Handshake holds the state of a Noise IK style handshake.
+//
+// The initiator knows the responder's static public key in advance, so the
+// first message is already encrypted to the responder and only the holder of
+// the matching private key can answer it.
+//
+// In hybrid mode the initiator also sends an ML-KEM-768 encapsulation key and
+// the responder answers with a ciphertext. The KEM shared secret is mixed into
+// the chaining key next to the X25519 results, so the session keys stay secret
+// unless both key exchanges are broken.
+type Handshake struct {
+	isInitiator     bool
+	chainingKey     [32]byte
+	hash            [32]byte
+	localStatic     *KeyPair
+	localEphemeral  *KeyPair
+	remoteStatic    [32]byte
+	remoteEphemeral [32]byte
+	presharedKey    [32]byte                   // Zero unless the peers share a PSK
+	kemPrivate      *mlkem.DecapsulationKey768 // Initiator's key when offering hybrid mode
+	kemPublic       *mlkem.EncapsulationKey768 // Responder's copy of the initiator's offer
+	hybrid          bool                       // KEM secret has been mixed in
+}
+
+// newHandshake initializes the symmetric state shared by both roles
+func newHandshake(isInitiator bool, localStatic *KeyPair, responderStatic [32]byte) *Handshake {
+	h := &Handshake{
+		isInitiator: isInitiator,
+		localStatic: localStatic,
+	}
+	h.chainingKey = sha256.Sum256([]byte(handshakeConstruction))
+	h.hash = h.chainingKey
+	h.mixHash([]byte(handshakeIdentifier))
+	h.mixHash(responderStatic[:])
+	return h
+}
+
+// NewInitiatorHandshake starts a handshake towards a responder with a known static key
+func NewInitiatorHandshake(localStatic *KeyPair, remoteStatic [32]byte) *Handshake {
+	h := newHandshake(true, localStatic, remoteStatic)
+	h.remoteStatic = remoteStatic
+	return h
+}
+
+// NewResponderHandshake prepares to answer a handshake using the local static key
+func NewResponderHandshake(localStatic *KeyPair) *Handshake {
+	return newHandshake(false, localStatic, localStatic.PublicKey)
+}
+
+// RemoteStatic returns the peer's static public key
+func (h *Handshake) RemoteStatic() [32]byte {
+	return h.remoteStatic
+}
+
+// SetPresharedKey sets the symmetric key both peers must hold. It is mixed
+// in before the init payload, so it must be set before SealInit on the
+// initiator and before OpenInitPayload on the responder.
+func (h *Handshake) SetPresharedKey(psk [32]byte) {
+	h.presharedKey = psk
+}
+
+// MixHeader binds the outer packet header of the next handshake message
+// into the transcript, so a rewritten header makes the handshake fail.
+// Both sides must call it right before sealing or opening that message.
+func (h *Handshake) MixHeader(header []byte) {
+	h.mixHash(header)
+}
+
+// Hybrid reports whether the ML-KEM shared secret was mixed into the keys
+func (h *Handshake) Hybrid() bool {
+	return h.hybrid
+}
+
+// OfferKEM generates an ML-KEM-768 key pair for hybrid mode and returns the
+// encapsulation key to send with the init. It must be called before SealInit.
+func (h *Handshake) OfferKEM() ([]byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+	h.kemPrivate = dk
+	encapsulationKey := dk.EncapsulationKey().Bytes()
+	h.mixHash(encapsulationKey)
+	return encapsulationKey, nil
+}
+
+// AcceptKEM records the initiator's ML-KEM-768 encapsulation key so that
+// SealResponse answers in hybrid mode. It must be called before OpenInitStatic.
+func (h *Handshake) AcceptKEM(encapsulationKey []byte) error {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return ErrInvalidKEMKey
+	}
+	h.kemPublic = ek
+	h.mixHash(encapsulationKey)
+	return nil
+}
+
+// MixTicket binds a resumption ticket, which travels in the clear, into the
+// transcript. It must be called before SealInit on the initiator and before
+// OpenInitStatic on the responder.
+func (h *Handshake) MixTicket(ticket []byte) {
+	h.mixHash(ticket)
+}
+
+// SealInit creates the initiator's first message:
+// ephemeral key, encrypted static key and an encrypted payload
+func (h *Handshake) SealInit(payload []byte) (ephemeral [32]byte, encryptedStatic [EncryptedStaticSize]byte, encryptedPayload []byte, err error) {
+	h.localEphemeral, err = GenerateKeyPair()
+	if err != nil {
+		return
+	}
+	ephemeral = h.localEphemeral.PublicKey
+	h.mixHash(ephemeral[:])
+
+	// es
+	if err = h.mixDH(h.localEphemeral.PrivateKey, h.remoteStatic); err != nil {
+		return
+	}
+	sealedStatic, err := h.encryptAndHash(h.localStatic.PublicKey[:])
+	if err != nil {
+		return
+	}
+	copy(encryptedStatic[:], sealedStatic)
+
+	// ss
+	if err = h.mixDH(h.localStatic.PrivateKey, h.remoteStatic); err != nil {
+		return
+	}
+	// psk
+	if err = h.mixKeyAndHash(h.presharedKey[:]); err != nil {
+		return
+	}
+	encryptedPayload, err = h.encryptAndHash(payload)
+	return
+}
+
+// OpenInitStatic processes the first half of the initiator's message on the
+// responder side and returns the initiator's static public key. The caller
+// looks up the peer, sets its pre-shared key and calls OpenInitPayload.
+func (h *Handshake) OpenInitStatic(ephemeral [32]byte, encryptedStatic [EncryptedStaticSize]byte) ([32]byte, error) {
+	var remoteStatic [32]byte
+	h.remoteEphemeral = ephemeral
+	h.mixHash(ephemeral[:])
+
+	// es
+	if err := h.mixDH(h.localStatic.PrivateKey, h.remoteEphemeral); err != nil {
+		return remoteStatic, err
+	}
+	static, err := h.decryptAndHash(encryptedStatic[:])
+	if err != nil {
+		return remoteStatic, err
+	}
+	copy(remoteStatic[:], static)
+
+	// ss
+	if err := h.mixDH(h.localStatic.PrivateKey, remoteStatic); err != nil {
+		return remoteStatic, err
+	}
+	h.remoteStatic = remoteStatic
+	return remoteStatic, nil
+}
+
+// OpenInitPayload decrypts the rest of the initiator's message. It fails
+// with ErrHandshakeAuth if the pre-shared keys differ.
+func (h *Handshake) OpenInitPayload(encryptedPayload []byte) ([]byte, error) {
+	// psk
+	if err := h.mixKeyAndHash(h.presharedKey[:]); err != nil {
+		return nil, err
+	}
+	return h.decryptAndHash(encryptedPayload)
+}
+
+// SealResponse creates the responder's reply: ephemeral key, the ML-KEM
+// ciphertext if the initiator offered hybrid mode, and encrypted payload
+func (h *Handshake) SealResponse(payload []byte) (ephemeral [32]byte, kemCiphertext []byte, encryptedPayload []byte, err error) {
+	h.localEphemeral, err = GenerateKeyPair()
+	if err != nil {
+		return
+	}
+	ephemeral = h.localEphemeral.PublicKey
+	h.mixHash(ephemeral[:])
+
+	// ee
+	if err = h.mixDH(h.localEphemeral.PrivateKey, h.remoteEphemeral); err != nil {
+		return
+	}
+	// se
+	if err = h.mixDH(h.localEphemeral.PrivateKey, h.remoteStatic); err != nil {
+		return
+	}
+	// kem
+	if h.kemPublic != nil {
+		var sharedSecret []byte
+		sharedSecret, kemCiphertext = h.kemPublic.Encapsulate()
+		h.mixHash(kemCiphertext)
+		err = h.mixKey(sharedSecret)
+		Wipe(sharedSecret)
+		if err != nil {
+			return
+		}
+		h.hybrid = true
+	}
+	encryptedPayload, err = h.encryptAndHash(payload)
+	return
+}
+
+// OpenResponse processes the responder's reply on the initiator side.
+// kemCiphertext is nil if the responder declined hybrid mode.
+// Failure means the responder does not hold the expected static private key.
+func (h *Handshake) OpenResponse(ephemeral [32]byte, kemCiphertext []byte, encryptedPayload []byte) ([]byte, error) {
+	h.remoteEphemeral = ephemeral
+	h.mixHash(ephemeral[:])
+
+	// ee
+	if err := h.mixDH(h.localEphemeral.PrivateKey, h.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	// se
+	if err := h.mixDH(h.localStatic.PrivateKey, h.remoteEphemeral); err != nil {
+		return nil, err
+	}
+	// kem
+	if kemCiphertext != nil {
+		if h.kemPrivate == nil {
+			return nil, ErrUnexpectedKEM
+		}
+		sharedSecret, err := h.kemPrivate.Decapsulate(kemCiphertext)
+		if err != nil {
+			return nil, ErrHandshakeAuth
+		}
+		h.mixHash(kemCiphertext)
+		err = h.mixKey(sharedSecret)
+		Wipe(sharedSecret)
+		if err != nil {
+			return nil, err
+		}
+		h.hybrid = true
+	}
+	return h.decryptAndHash(encryptedPayload)
+}
+
+// Keyring derives the transport keys for the negotiated cipher suite once
+// both messages have been processed. The chaining key carries every DH
+// result and, in hybrid mode, the KEM secret.
+func (h *Handshake) Keyring(suite CipherSuite) (*Keyring, error) {
+	session, err := DeriveSessionKeys(h.chainingKey, h.isInitiator, h.hash[:], suite)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret [32]byte
+	defer Wipe(secret[:])
+	kdf := hkdf.New(sha256.New, h.chainingKey[:], h.hash[:], []byte("hydravpn-rekey-secret"))
+	if _, err := io.ReadFull(kdf, secret[:]); err != nil {
+		session.Destroy()
+		return nil, err
+	}
+
+	return NewKeyring(session, secret, h.isInitiator), nil
+}
+
+// HeaderProtector derives the header protection keys of the session. Like
+// Keyring, it must be called before Destroy. The keys outlive rekeys.
+func (h *Handshake) HeaderProtector() (*HeaderProtector, error) {
+	var keys [64]byte
+	defer Wipe(keys[:])
+	kdf := hkdf.New(sha256.New, h.chainingKey[:], h.hash[:], []byte("hydravpn-header-protection"))
+	if _, err := io.ReadFull(kdf, keys[:]); err != nil {
+		return nil, err
+	}
+
+	// Initiator sends with the first key, responder with the second
+	sendKey, receiveKey := keys[:32], keys[32:]
+	if !h.isInitiator {
+		sendKey, receiveKey = receiveKey, sendKey
+	}
+	return NewHeaderProtector(sendKey, receiveKey)
+}
+
+// Destroy wipes the handshake's secrets: the chaining key, the pre-shared
+// key and the ephemeral keys. The local static key belongs to the caller
+// and is left alone. Call it once the Keyring has been derived or the
+// handshake has failed.
+func (h *Handshake) Destroy() {
+	Wipe(h.chainingKey[:])
+	Wipe(h.hash[:])
+	Wipe(h.presharedKey[:])
+	h.localEphemeral.Destroy()
+	h.kemPrivate = nil
+	h.kemPublic = nil
+}
+
+// mixHash absorbs data into the transcript hash
+func (h *Handshake) mixHash(data []byte) {
+	hash := sha256.New()
+	hash.Write(h.hash[:])
+	hash.Write(data)
+	hash.Sum(h.hash[:0])
+}
+
+// mixDH performs a Diffie-Hellman operation and ratchets the chaining key
+func (h *Handshake) mixDH(privateKey, publicKey [32]byte) error {
+	sharedSecret, err := ComputeSharedSecret(privateKey, publicKey)
+	if err != nil {
+		return err
+	}
+	defer Wipe(sharedSecret[:])
+	return h.mixKey(sharedSecret[:])
+}
+
+// mixKey ratchets the chaining key with new input key material
+func (h *Handshake) mixKey(input []byte) error {
+	kdf := hkdf.New(sha256.New, input, h.chainingKey[:], nil)
+	if _, err := io.ReadFull(kdf, h.chainingKey[:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mixKeyAndHash ratchets the chaining key with a pre-shared key and binds
+// the result into the transcript
+func (h *Handshake) mixKeyAndHash(input []byte) error {
+	var tempHash [32]byte
+	kdf := hkdf.New(sha256.New, input, h.chainingKey[:], []byte("psk"))
+	if _, err := io.ReadFull(kdf, h.chainingKey[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(kdf, tempHash[:]); err != nil {
+		return err
+	}
+	h.mixHash(tempHash[:])
+	return nil
+}
+
+// messageKey derives the one-time key for the next handshake AEAD operation
+func (h *Handshake) messageKey() ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, nil, h.chainingKey[:], []byte("message key"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// encryptAndHash seals plaintext bound to the transcript and absorbs the ciphertext
+func (h *Handshake) encryptAndHash(plaintext []byte) ([]byte, error) {
+	key, err := h.messageKey()
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each message key is used exactly once, so a zero nonce is safe
+	var nonce [chacha20poly1305.NonceSize]byte
+	ciphertext := aead.Seal(nil, nonce[:], plaintext, h.hash[:])
+	h.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+// decryptAndHash opens ciphertext bound to the transcript and absorbs it
+func (h *Handshake) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	key, err := h.messageKey()
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	plaintext, err := aead.Open(nil, nonce[:], ciphertext, h.hash[:])
+	if err != nil {
+		return nil, ErrHandshakeAuth
+	}
+	h.mixHash(ciphertext)
+	return plaintext, nil
+}
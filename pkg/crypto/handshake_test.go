@@ -0,0 +1,354 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"errors"
+	"testing"
+)
+
+// newTestKeyPair generates a static key pair or fails the test
+func newTestKeyPair(tb testing.TB) *KeyPair {
+	tb.Helper()
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return kp
+}
+
+// completeHandshake runs both handshake messages between initiator and
+// responder, checking that the payloads arrive, and returns the keyrings of
+// both sides
+func completeHandshake(tb testing.TB, initiator, responder *Handshake, hybrid bool) (*Keyring, *Keyring) {
+	tb.Helper()
+	if hybrid {
+		encapsulationKey, err := initiator.OfferKEM()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := responder.AcceptKEM(encapsulationKey); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	ephemeral, encryptedStatic, encryptedPayload, err := initiator.SealInit([]byte("init"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := responder.OpenInitStatic(ephemeral, encryptedStatic); err != nil {
+		tb.Fatal(err)
+	}
+	payload, err := responder.OpenInitPayload(encryptedPayload)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("init")) {
+		tb.Fatalf("init payload = %q", payload)
+	}
+
+	ephemeral, kemCiphertext, encryptedPayload, err := responder.SealResponse([]byte("response"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	payload, err = initiator.OpenResponse(ephemeral, kemCiphertext, encryptedPayload)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("response")) {
+		tb.Fatalf("response payload = %q", payload)
+	}
+
+	initiatorKeys, err := initiator.Keyring(CipherSuiteAES256GCM)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	responderKeys, err := responder.Keyring(CipherSuiteAES256GCM)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return initiatorKeys, responderKeys
+}
+
+// checkKeyrings checks that packets sealed by either side open on the other
+func checkKeyrings(t *testing.T, initiatorKeys, responderKeys *Keyring) {
+	t.Helper()
+	for _, dir := range []struct {
+		name     string
+		from, to *Keyring
+	}{{"initiator to responder", initiatorKeys, responderKeys}, {"responder to initiator", responderKeys, initiatorKeys}} {
+		ciphertext, err := dir.from.Encrypt([]byte(dir.name), []byte("header"))
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		plaintext, err := dir.to.Decrypt(ciphertext, []byte("header"))
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if string(plaintext) != dir.name {
+			t.Fatalf("%s: got %q", dir.name, plaintext)
+		}
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	client, server := newTestKeyPair(t), newTestKeyPair(t)
+	initiator := NewInitiatorHandshake(client, server.PublicKey)
+	responder := NewResponderHandshake(server)
+	initiator.MixHeader([]byte("init header"))
+	responder.MixHeader([]byte("init header"))
+
+	initiatorKeys, responderKeys := completeHandshake(t, initiator, responder, false)
+	if responder.RemoteStatic() != client.PublicKey {
+		t.Fatal("responder learned the wrong client key")
+	}
+	if initiator.Hybrid() || responder.Hybrid() {
+		t.Fatal("classic handshake reports hybrid mode")
+	}
+	checkKeyrings(t, initiatorKeys, responderKeys)
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	client, server, other := newTestKeyPair(t), newTestKeyPair(t), newTestKeyPair(t)
+
+	// The client pinned a key the server does not hold
+	initiator := NewInitiatorHandshake(client, other.PublicKey)
+	responder := NewResponderHandshake(server)
+	ephemeral, encryptedStatic, _, err := initiator.SealInit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.OpenInitStatic(ephemeral, encryptedStatic); !errors.Is(err, ErrHandshakeAuth) {
+		t.Fatalf("err = %v, want ErrHandshakeAuth", err)
+	}
+}
+
+func TestHandshakeTamperedMessages(t *testing.T) {
+	tests := []struct {
+		name           string
+		tamperInit     func(encryptedStatic, encryptedPayload []byte)
+		tamperResponse func(encryptedPayload []byte)
+		header         string // Header bound by the responder instead of the initiator's
+	}{
+		{name: "init static", tamperInit: func(static, _ []byte) { static[0] ^= 1 }},
+		{name: "init payload", tamperInit: func(_, payload []byte) { payload[len(payload)-1] ^= 1 }},
+		{name: "response payload", tamperResponse: func(payload []byte) { payload[0] ^= 1 }},
+		{name: "init header", header: "other header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestKeyPair(t), newTestKeyPair(t)
+			initiator := NewInitiatorHandshake(client, server.PublicKey)
+			responder := NewResponderHandshake(server)
+			initiator.MixHeader([]byte("header"))
+			if tt.header != "" {
+				responder.MixHeader([]byte(tt.header))
+			} else {
+				responder.MixHeader([]byte("header"))
+			}
+
+			ephemeral, encryptedStatic, encryptedPayload, err := initiator.SealInit([]byte("init"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamperInit != nil {
+				tt.tamperInit(encryptedStatic[:], encryptedPayload)
+			}
+			_, err = responder.OpenInitStatic(ephemeral, encryptedStatic)
+			if err == nil {
+				_, err = responder.OpenInitPayload(encryptedPayload)
+			}
+			if tt.tamperResponse == nil {
+				if !errors.Is(err, ErrHandshakeAuth) {
+					t.Fatalf("opening the init: err = %v, want ErrHandshakeAuth", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ephemeral, kemCiphertext, response, err := responder.SealResponse([]byte("response"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tamperResponse(response)
+			if _, err := initiator.OpenResponse(ephemeral, kemCiphertext, response); !errors.Is(err, ErrHandshakeAuth) {
+				t.Fatalf("opening the response: err = %v, want ErrHandshakeAuth", err)
+			}
+		})
+	}
+}
+
+func TestHybridHandshakeRoundTrip(t *testing.T) {
+	client, server := newTestKeyPair(t), newTestKeyPair(t)
+	initiator := NewInitiatorHandshake(client, server.PublicKey)
+	responder := NewResponderHandshake(server)
+
+	initiatorKeys, responderKeys := completeHandshake(t, initiator, responder, true)
+	if !initiator.Hybrid() || !responder.Hybrid() {
+		t.Fatal("hybrid handshake reports classic mode")
+	}
+	checkKeyrings(t, initiatorKeys, responderKeys)
+}
+
+// hybridResponse runs a hybrid handshake up to the responder's reply
+func hybridResponse(t *testing.T) (initiator *Handshake, ephemeral [32]byte, kemCiphertext, encryptedPayload []byte) {
+	t.Helper()
+	client, server := newTestKeyPair(t), newTestKeyPair(t)
+	initiator = NewInitiatorHandshake(client, server.PublicKey)
+	responder := NewResponderHandshake(server)
+	encapsulationKey, err := initiator.OfferKEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.AcceptKEM(encapsulationKey); err != nil {
+		t.Fatal(err)
+	}
+
+	initEphemeral, encryptedStatic, initPayload, err := initiator.SealInit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.OpenInitStatic(initEphemeral, encryptedStatic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.OpenInitPayload(initPayload); err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, kemCiphertext, encryptedPayload, err = responder.SealResponse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, ephemeral, kemCiphertext, encryptedPayload
+}
+
+func TestHybridHandshakeTamperedKEMCiphertext(t *testing.T) {
+	initiator, ephemeral, kemCiphertext, encryptedPayload := hybridResponse(t)
+	kemCiphertext[0] ^= 1
+	if _, err := initiator.OpenResponse(ephemeral, kemCiphertext, encryptedPayload); !errors.Is(err, ErrHandshakeAuth) {
+		t.Fatalf("err = %v, want ErrHandshakeAuth", err)
+	}
+}
+
+func TestHybridHandshakeStrippedKEMCiphertext(t *testing.T) {
+	// Dropping the ciphertext must not downgrade the session to classic mode
+	initiator, ephemeral, _, encryptedPayload := hybridResponse(t)
+	if _, err := initiator.OpenResponse(ephemeral, nil, encryptedPayload); !errors.Is(err, ErrHandshakeAuth) {
+		t.Fatalf("err = %v, want ErrHandshakeAuth", err)
+	}
+}
+
+func TestHandshakeUnexpectedKEMCiphertext(t *testing.T) {
+	client, server := newTestKeyPair(t), newTestKeyPair(t)
+	initiator := NewInitiatorHandshake(client, server.PublicKey)
+	responder := NewResponderHandshake(server)
+	ephemeral, encryptedStatic, encryptedPayload, err := initiator.SealInit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.OpenInitStatic(ephemeral, encryptedStatic); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.OpenInitPayload(encryptedPayload); err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, _, encryptedPayload, err = responder.SealResponse(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := initiator.OpenResponse(ephemeral, make([]byte, mlkem.CiphertextSize768), encryptedPayload); !errors.Is(err, ErrUnexpectedKEM) {
+		t.Fatalf("err = %v, want ErrUnexpectedKEM", err)
+	}
+}
+
+func TestAcceptKEMRejectsInvalidKey(t *testing.T) {
+	responder := NewResponderHandshake(newTestKeyPair(t))
+	if err := responder.AcceptKEM(make([]byte, 10)); !errors.Is(err, ErrInvalidKEMKey) {
+		t.Fatalf("err = %v, want ErrInvalidKEMKey", err)
+	}
+}
+
+func TestHandshakePresharedKey(t *testing.T) {
+	psk, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPSK, err := GeneratePresharedKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                       string
+		initiatorPSK, responderPSK [32]byte
+		ok                         bool
+	}{
+		{"both without", [32]byte{}, [32]byte{}, true},
+		{"matching", psk, psk, true},
+		{"different", psk, otherPSK, false},
+		{"only initiator", psk, [32]byte{}, false},
+		{"only responder", [32]byte{}, psk, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := newTestKeyPair(t), newTestKeyPair(t)
+			initiator := NewInitiatorHandshake(client, server.PublicKey)
+			initiator.SetPresharedKey(tt.initiatorPSK)
+			responder := NewResponderHandshake(server)
+
+			ephemeral, encryptedStatic, encryptedPayload, err := initiator.SealInit([]byte("init"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The static key opens without the PSK, so the server can look it up
+			remoteStatic, err := responder.OpenInitStatic(ephemeral, encryptedStatic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remoteStatic != client.PublicKey {
+				t.Fatal("responder learned the wrong client key")
+			}
+			responder.SetPresharedKey(tt.responderPSK)
+
+			_, err = responder.OpenInitPayload(encryptedPayload)
+			if !tt.ok {
+				if !errors.Is(err, ErrHandshakeAuth) {
+					t.Fatalf("err = %v, want ErrHandshakeAuth", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ephemeral, kemCiphertext, response, err := responder.SealResponse(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := initiator.OpenResponse(ephemeral, kemCiphertext, response); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	for _, mode := range []struct {
+		name   string
+		hybrid bool
+	}{{"classic", false}, {"hybrid", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			client, server := newTestKeyPair(b), newTestKeyPair(b)
+			b.ReportAllocs()
+			for b.Loop() {
+				initiator := NewInitiatorHandshake(client, server.PublicKey)
+				responder := NewResponderHandshake(server)
+				initiatorKeys, responderKeys := completeHandshake(b, initiator, responder, mode.hybrid)
+				initiatorKeys.Destroy()
+				responderKeys.Destroy()
+				initiator.Destroy()
+				responder.Destroy()
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+)
+
+// Header protection constants
+const (
+	// HeaderProtectionSampleSize is the ciphertext sampled to mask a header
+	HeaderProtectionSampleSize = aes.BlockSize
+
+	// MaxProtectedSize is the most leading bytes of a packet that can be masked
+	MaxProtectedSize = 2 * aes.BlockSize
+
+	handshakeLabelInitiator = "hsmask-i"
+	handshakeLabelResponder = "hsmask-r"
+)
+
+// ErrPacketTooShort is returned when a packet has no ciphertext to sample
+var ErrPacketTooShort = errors.New("packet too short for header protection")
+
+// HeaderProtector masks the cleartext start of sealed packets, like QUIC
+// header protection, so no byte of a packet is predictable on the wire.
+// The mask is AES-256 applied to a sample of the ciphertext following the
+// masked bytes, which the AEAD makes unpredictable, so the same header
+// never masks the same way twice. Each direction has its own key. It is
+// safe for concurrent use.
+type HeaderProtector struct {
+	send    cipher.Block
+	receive cipher.Block
+}
+
+// NewHeaderProtector creates a protector from the keys of both directions
+func NewHeaderProtector(sendKey, receiveKey []byte) (*HeaderProtector, error) {
+	send, err := aes.NewCipher(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := aes.NewCipher(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderProtector{send: send, receive: receive}, nil
+}
+
+// NewHandshakeProtector creates a protector for handshake packets, which
+// go out before any session key exists. Like the cookie keys, its keys are
+// derived from the server's public key, so only peers that know it can
+// unmask a handshake.
+func NewHandshakeProtector(serverPublicKey [32]byte, isInitiator bool) (*HeaderProtector, error) {
+	initiatorKey := sha256.Sum256(append([]byte(handshakeLabelInitiator), serverPublicKey[:]...))
+	responderKey := sha256.Sum256(append([]byte(handshakeLabelResponder), serverPublicKey[:]...))
+	if !isInitiator {
+		return NewHeaderProtector(responderKey[:], initiatorKey[:])
+	}
+	return NewHeaderProtector(initiatorKey[:], responderKey[:])
+}
+
+// Protect masks the first n bytes of an outgoing packet in place
+func (p *HeaderProtector) Protect(packet []byte, n int) error {
+	return applyMask(p.send, packet, n)
+}
+
+// Unprotect removes the mask from the first n bytes of a received packet
+// in place. A forged packet unmasks to garbage, which fails to parse or
+// to authenticate.
+func (p *HeaderProtector) Unprotect(packet []byte, n int) error {
+	return applyMask(p.receive, packet, n)
+}
+
+// applyMask XORs the first n bytes of packet with the mask derived from
+// the sample after them. Masking twice restores the original bytes.
+func applyMask(block cipher.Block, packet []byte, n int) error {
+	if n > MaxProtectedSize {
+		return errors.New("header protection covers too many bytes")
+	}
+	if len(packet) < n+HeaderProtectionSampleSize {
+		return ErrPacketTooShort
+	}
+
+	var input [aes.BlockSize]byte
+	var mask [MaxProtectedSize]byte
+	copy(input[:], packet[n:n+HeaderProtectionSampleSize])
+	block.Encrypt(mask[:aes.BlockSize], input[:])
+	input[aes.BlockSize-1] ^= 1
+	block.Encrypt(mask[aes.BlockSize:], input[:])
+
+	for i := range n {
+		packet[i] ^= mask[i]
+	}
+	return nil
+}
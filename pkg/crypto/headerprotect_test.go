@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHeaderProtector(t *testing.T) {
+	sendKey, receiveKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	sender, err := NewHeaderProtector(sendKey, receiveKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewHeaderProtector(receiveKey, sendKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := []byte("header and nonce||sampled ciphertext bytes")
+	original := append([]byte(nil), packet...)
+	const n = 16
+	if err := sender.Protect(packet, n); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(packet[:n], original[:n]) {
+		t.Fatal("header not masked")
+	}
+	if !bytes.Equal(packet[n:], original[n:]) {
+		t.Fatal("bytes after the header changed")
+	}
+
+	// The sender's own receive key does not unmask its packets
+	wrong := append([]byte(nil), packet...)
+	if err := sender.Unprotect(wrong, n); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(wrong, original) {
+		t.Fatal("unmasked with the key of the other direction")
+	}
+
+	if err := receiver.Unprotect(packet, n); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet, original) {
+		t.Fatal("unmasked header differs")
+	}
+}
+
+func TestHeaderProtectorErrors(t *testing.T) {
+	p, err := NewHeaderProtector(make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Protect(make([]byte, 4+HeaderProtectionSampleSize-1), 4); err != ErrPacketTooShort {
+		t.Fatalf("short packet: err = %v, want ErrPacketTooShort", err)
+	}
+	if err := p.Protect(make([]byte, 64), MaxProtectedSize+1); err == nil {
+		t.Fatal("masked more than MaxProtectedSize bytes")
+	}
+	if _, err := NewHeaderProtector(make([]byte, 7), make([]byte, 32)); err == nil {
+		t.Fatal("accepted an invalid key size")
+	}
+}
+
+func TestHandshakeProtector(t *testing.T) {
+	server := newTestKeyPair(t)
+	client, err := NewHandshakeProtector(server.PublicKey, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshakeProtector(server.PublicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewHandshakeProtector(newTestKeyPair(t).PublicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const headerSize = 14
+	for _, tt := range []struct {
+		name           string
+		from, to, fail *HeaderProtector
+	}{
+		{"init", client, responder, other},
+		{"answer", responder, client, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			packet := append([]byte("HV\x02\x01sessionid\x00\x40"), bytes.Repeat([]byte{0x5a}, 32)...)
+			original := append([]byte(nil), packet...)
+			if err := tt.from.Protect(packet, headerSize); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(packet[:headerSize], original[:headerSize]) {
+				t.Fatal("header not masked")
+			}
+
+			// Only holders of the same server key can unmask
+			if tt.fail != nil {
+				wrong := append([]byte(nil), packet...)
+				if err := tt.fail.Unprotect(wrong, headerSize); err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(wrong, original) {
+					t.Fatal("unmasked with another server's key")
+				}
+			}
+			if err := tt.to.Unprotect(packet, headerSize); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(packet, original) {
+				t.Fatal("unmasked header differs")
+			}
+		})
+	}
+}
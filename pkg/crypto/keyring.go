@@ -0,0 +1,312 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Rekey constants
+const (
+	// EpochSize is the size of the key epoch preceding each ciphertext
+	EpochSize = 1
+
+	// PrefixSize is what a Keyring writes before the sealed data: epoch and counter
+	PrefixSize = EpochSize + CounterSize
+
+	// RekeyOverlap is how long the previous keys keep decrypting after a rekey
+	RekeyOverlap = 10 * time.Second
+
+	// RekeyTimeout is how long to wait for a rekey response before retrying
+	RekeyTimeout = 5 * time.Second
+
+	// RekeyAfterMessages forces a rekey long before the nonce counter runs out
+	RekeyAfterMessages = 1 << 60
+)
+
+// Rekey errors
+var (
+	ErrUnknownEpoch    = errors.New("unknown key epoch")
+	ErrNoRekeyPending  = errors.New("no rekey in progress")
+	ErrRekeyCollision  = errors.New("simultaneous rekey, peer's request ignored")
+	ErrUnexpectedEpoch = errors.New("unexpected rekey epoch")
+)
+
+// Keyring rotates the Sessions of one tunnel. The initiator of a rekey
+// switches to the new keys as soon as it gets the response; the responder
+// switches once the first packet under the new keys arrives. The previous
+// keys keep decrypting for RekeyOverlap so in-flight packets are not lost.
+type Keyring struct {
+	mu             sync.RWMutex
+	isInitiator    bool // Role in the original handshake, fixes key direction
+	secret         [32]byte
+	current        *Session
+	previous       *Session
+	previousExpiry time.Time
+	next           *Session
+	nextSecret     [32]byte
+	pending        *KeyPair
+	pendingSince   time.Time
+}
+
+// NewKeyring creates a keyring starting with the given session.
+// The secret is mixed into every subsequent rekey.
+func NewKeyring(session *Session, secret [32]byte, isInitiator bool) *Keyring {
+	return &Keyring{
+		isInitiator: isInitiator,
+		secret:      secret,
+		current:     session,
+	}
+}
+
+// Current returns the session used for sending
+func (k *Keyring) Current() *Session {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Overhead returns how much longer a ciphertext is than its plaintext
+func (k *Keyring) Overhead() int {
+	return EpochSize + k.Current().Overhead()
+}
+
+// Encrypt encrypts plaintext with the current keys, prefixing the key epoch.
+// additionalData is authenticated but not encrypted.
+func (k *Keyring) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	return k.SealAppend(make([]byte, 0, k.Overhead()+len(plaintext)), plaintext, additionalData)
+}
+
+// SealAppend is like Encrypt but appends the result to dst. plaintext may
+// alias dst[len(dst)+PrefixSize:] for in-place encryption.
+func (k *Keyring) SealAppend(dst, plaintext, additionalData []byte) ([]byte, error) {
+	session := k.Current()
+	return session.SealAppend(append(dst, session.epoch), plaintext, additionalData)
+}
+
+// Decrypt decrypts ciphertext with the keys of its epoch and verifies
+// additionalData
+func (k *Keyring) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	return k.OpenAppend(nil, ciphertext, additionalData)
+}
+
+// OpenAppend is like Decrypt but appends the plaintext to dst. Passing
+// ciphertext[PrefixSize:PrefixSize] as dst decrypts in place.
+func (k *Keyring) OpenAppend(dst, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < EpochSize {
+		return nil, ErrCiphertextTooShort
+	}
+	epoch := ciphertext[0]
+
+	k.mu.RLock()
+	var session *Session
+	confirming := false
+	switch {
+	case epoch == k.current.epoch:
+		session = k.current
+	case k.next != nil && epoch == k.next.epoch:
+		session = k.next
+		confirming = true
+	case k.previous != nil && epoch == k.previous.epoch && time.Now().Before(k.previousExpiry):
+		session = k.previous
+	}
+	k.mu.RUnlock()
+
+	if session == nil {
+		return nil, ErrUnknownEpoch
+	}
+
+	plaintext, err := session.OpenAppend(dst, ciphertext[EpochSize:], additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer is using the new keys, so it is safe to send with them too
+	if confirming {
+		k.mu.Lock()
+		if k.next == session {
+			k.secret = k.nextSecret
+			Wipe(k.nextSecret[:])
+			k.rotate(session)
+			k.next = nil
+		}
+		k.mu.Unlock()
+	}
+
+	return plaintext, nil
+}
+
+// NeedsRekey reports whether the current keys are older than afterTime or
+// have carried more than afterBytes, and no rekey is already in flight.
+// While answered keys await the peer's confirmation, starting another
+// rekey would only collide with the peer's.
+func (k *Keyring) NeedsRekey(afterTime time.Duration, afterBytes uint64) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.pending != nil && time.Since(k.pendingSince) < RekeyTimeout {
+		return false
+	}
+	if k.next != nil {
+		return false
+	}
+
+	current := k.current
+	return (afterTime > 0 && current.Age() >= afterTime) ||
+		(afterBytes > 0 && current.Bytes() >= afterBytes) ||
+		current.sendCounter.Load() >= RekeyAfterMessages
+}
+
+// StartRekey begins a rekey and returns the new epoch and the ephemeral
+// public key to send to the peer
+func (k *Keyring) StartRekey() (epoch uint8, ephemeral [32]byte, err error) {
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return 0, ephemeral, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending.Destroy() // A retry replaces the unanswered request
+	k.pending = kp
+	k.pendingSince = time.Now()
+	return k.current.epoch + 1, kp.PublicKey, nil
+}
+
+// HandleRekeyInit answers a peer's rekey request. The new keys are held
+// back until the peer confirms them by using them. It returns the
+// ephemeral public key to send back.
+func (k *Keyring) HandleRekeyInit(epoch uint8, peerEphemeral [32]byte) ([32]byte, error) {
+	var ephemeral [32]byte
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if epoch != k.current.epoch+1 {
+		return ephemeral, ErrUnexpectedEpoch
+	}
+
+	// Both sides asked at once: the original handshake initiator wins
+	if k.pending != nil {
+		if k.isInitiator {
+			return ephemeral, ErrRekeyCollision
+		}
+		k.pending.Destroy()
+		k.pending = nil
+	}
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return ephemeral, err
+	}
+	defer kp.Destroy()
+	session, secret, err := k.derive(kp.PrivateKey, peerEphemeral, epoch)
+	if err != nil {
+		return ephemeral, err
+	}
+
+	// A repeated request replaces keys the peer never confirmed
+	if k.next != nil {
+		k.next.Destroy()
+	}
+	k.next = session
+	k.nextSecret = secret
+	return kp.PublicKey, nil
+}
+
+// HandleRekeyResponse completes a rekey started with StartRekey and
+// switches to the new keys immediately
+func (k *Keyring) HandleRekeyResponse(epoch uint8, peerEphemeral [32]byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.pending == nil {
+		return ErrNoRekeyPending
+	}
+	if epoch != k.current.epoch+1 {
+		return ErrUnexpectedEpoch
+	}
+
+	session, secret, err := k.derive(k.pending.PrivateKey, peerEphemeral, epoch)
+	if err != nil {
+		return err
+	}
+
+	k.pending.Destroy()
+	k.pending = nil
+	k.secret = secret
+	Wipe(secret[:])
+	k.rotate(session)
+	return nil
+}
+
+// derive computes the next session and the rekey secret that replaces
+// the current one once the session is in use. Must be called with k.mu held.
+func (k *Keyring) derive(privateKey, peerEphemeral [32]byte, epoch uint8) (*Session, [32]byte, error) {
+	var secret [32]byte
+	sharedSecret, err := ComputeSharedSecret(privateKey, peerEphemeral)
+	if err != nil {
+		return nil, secret, err
+	}
+	defer Wipe(sharedSecret[:])
+
+	session, err := DeriveSessionKeys(sharedSecret, k.isInitiator, k.secret[:], k.current.suite)
+	if err != nil {
+		return nil, secret, err
+	}
+	session.epoch = epoch
+
+	kdf := hkdf.New(sha256.New, sharedSecret[:], k.secret[:], []byte("hydravpn-rekey-secret"))
+	if _, err := io.ReadFull(kdf, secret[:]); err != nil {
+		session.Destroy()
+		return nil, secret, err
+	}
+
+	return session, secret, nil
+}
+
+// rotate makes session current and keeps the old one for the overlap period,
+// after which its keys are destroyed. Must be called with k.mu held.
+func (k *Keyring) rotate(session *Session) {
+	if k.previous != nil {
+		k.previous.Destroy()
+	}
+	old := k.current
+	k.previous = old
+	k.previousExpiry = time.Now().Add(RekeyOverlap)
+	k.current = session
+
+	time.AfterFunc(RekeyOverlap, func() {
+		k.mu.Lock()
+		if k.previous == old {
+			k.previous = nil
+		}
+		k.mu.Unlock()
+		old.Destroy()
+	})
+}
+
+// Destroy wipes the rekey secrets and drops every session held by the
+// keyring, whose AEAD keys cannot be wiped (see Session). It is called
+// when the tunnel closes; any later Encrypt or Decrypt fails with
+// ErrSessionDestroyed.
+func (k *Keyring) Destroy() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, session := range []*Session{k.current, k.previous, k.next} {
+		if session != nil {
+			session.Destroy()
+		}
+	}
+	k.previous = nil
+	k.next = nil
+	k.pending.Destroy()
+	k.pending = nil
+	Wipe(k.secret[:])
+	Wipe(k.nextSecret[:])
+}
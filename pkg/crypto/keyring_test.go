@@ -0,0 +1,267 @@
+package crypto
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newKeyringPair completes a handshake and returns the keyrings of the
+// handshake initiator and responder
+func newKeyringPair(t *testing.T) (initiator, responder *Keyring) {
+	t.Helper()
+	client, server := newTestKeyPair(t), newTestKeyPair(t)
+	initiatorHandshake := NewInitiatorHandshake(client, server.PublicKey)
+	responderHandshake := NewResponderHandshake(server)
+	initiator, responder = completeHandshake(t, initiatorHandshake, responderHandshake, false)
+	t.Cleanup(func() {
+		initiator.Destroy()
+		responder.Destroy()
+	})
+	return initiator, responder
+}
+
+// mustSeal encrypts a packet or fails the test
+func mustSeal(t *testing.T, k *Keyring, message string) []byte {
+	t.Helper()
+	ciphertext, err := k.Encrypt([]byte(message), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+// mustOpen decrypts a packet and checks its contents, or fails the test
+func mustOpen(t *testing.T, k *Keyring, ciphertext []byte, message string) {
+	t.Helper()
+	plaintext, err := k.Decrypt(ciphertext, nil)
+	if err != nil {
+		t.Fatalf("decrypt %q: %v", message, err)
+	}
+	if string(plaintext) != message {
+		t.Fatalf("decrypted %q, want %q", plaintext, message)
+	}
+}
+
+// rekey runs a full rekey started by from and returns the new epoch
+func rekey(t *testing.T, from, to *Keyring) uint8 {
+	t.Helper()
+	epoch, ephemeral, err := from.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := to.HandleRekeyInit(epoch, ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := from.HandleRekeyResponse(epoch, response); err != nil {
+		t.Fatal(err)
+	}
+	// The first packet under the new keys confirms them
+	mustOpen(t, to, mustSeal(t, from, "confirm"), "confirm")
+	return epoch
+}
+
+func TestKeyringRekey(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	epoch, ephemeral, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if epoch != 1 {
+		t.Fatalf("first rekey epoch = %d, want 1", epoch)
+	}
+	inFlight := mustSeal(t, responder, "in flight")
+
+	response, err := responder.HandleRekeyInit(epoch, ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Until the initiator confirms, the responder keeps sending old keys
+	if got := responder.Current().epoch; got != 0 {
+		t.Fatalf("responder switched to epoch %d before confirmation", got)
+	}
+	beforeConfirm := mustSeal(t, responder, "before confirm")
+
+	if err := initiator.HandleRekeyResponse(epoch, response); err != nil {
+		t.Fatal(err)
+	}
+	if got := initiator.Current().epoch; got != epoch {
+		t.Fatalf("initiator epoch = %d, want %d", got, epoch)
+	}
+
+	// Packets under the old keys still open during the overlap
+	mustOpen(t, initiator, inFlight, "in flight")
+	mustOpen(t, initiator, beforeConfirm, "before confirm")
+
+	// The confirm is the first packet under the new keys
+	mustOpen(t, responder, mustSeal(t, initiator, "confirm"), "confirm")
+	if got := responder.Current().epoch; got != epoch {
+		t.Fatalf("responder epoch after confirm = %d, want %d", got, epoch)
+	}
+	mustOpen(t, initiator, mustSeal(t, responder, "new keys"), "new keys")
+}
+
+func TestKeyringEpochTransitions(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	// Either side may start, and epochs wrap around
+	for round := 1; round <= 300; round++ {
+		from, to := initiator, responder
+		if round%2 == 0 {
+			from, to = responder, initiator
+		}
+		if epoch, want := rekey(t, from, to), uint8(round); epoch != want {
+			t.Fatalf("round %d: epoch = %d, want %d", round, epoch, want)
+		}
+		if initiator.Current().epoch != responder.Current().epoch {
+			t.Fatalf("round %d: epochs differ", round)
+		}
+		mustOpen(t, from, mustSeal(t, to, "reply"), "reply")
+	}
+}
+
+func TestKeyringRejectsUnknownEpoch(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+	ciphertext := mustSeal(t, initiator, "data")
+	ciphertext[0] = 7
+	if _, err := responder.Decrypt(ciphertext, nil); !errors.Is(err, ErrUnknownEpoch) {
+		t.Fatalf("err = %v, want ErrUnknownEpoch", err)
+	}
+}
+
+func TestKeyringRekeyErrors(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	var ephemeral [32]byte
+	if err := initiator.HandleRekeyResponse(1, ephemeral); !errors.Is(err, ErrNoRekeyPending) {
+		t.Fatalf("response without request: err = %v, want ErrNoRekeyPending", err)
+	}
+
+	epoch, ephemeral, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.HandleRekeyInit(epoch+1, ephemeral); !errors.Is(err, ErrUnexpectedEpoch) {
+		t.Fatalf("skipped epoch: err = %v, want ErrUnexpectedEpoch", err)
+	}
+	response, err := responder.HandleRekeyInit(epoch, ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.HandleRekeyResponse(epoch+1, response); !errors.Is(err, ErrUnexpectedEpoch) {
+		t.Fatalf("response for another epoch: err = %v, want ErrUnexpectedEpoch", err)
+	}
+}
+
+func TestKeyringRekeyCollision(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	initiatorEpoch, initiatorEphemeral, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderEpoch, responderEphemeral, err := responder.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The handshake initiator's request wins
+	if _, err := initiator.HandleRekeyInit(responderEpoch, responderEphemeral); !errors.Is(err, ErrRekeyCollision) {
+		t.Fatalf("err = %v, want ErrRekeyCollision", err)
+	}
+	response, err := responder.HandleRekeyInit(initiatorEpoch, initiatorEphemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.HandleRekeyResponse(initiatorEpoch, response); err != nil {
+		t.Fatal(err)
+	}
+	mustOpen(t, responder, mustSeal(t, initiator, "confirm"), "confirm")
+	mustOpen(t, initiator, mustSeal(t, responder, "reply"), "reply")
+}
+
+func TestKeyringRetriedRekey(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	// The first response is lost and the initiator retries
+	epoch, ephemeral, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.HandleRekeyInit(epoch, ephemeral); err != nil {
+		t.Fatal(err)
+	}
+	epoch, ephemeral, err = initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := responder.HandleRekeyInit(epoch, ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.HandleRekeyResponse(epoch, response); err != nil {
+		t.Fatal(err)
+	}
+	mustOpen(t, responder, mustSeal(t, initiator, "confirm"), "confirm")
+	mustOpen(t, initiator, mustSeal(t, responder, "reply"), "reply")
+}
+
+func TestKeyringNeedsRekey(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+
+	if initiator.NeedsRekey(time.Hour, 1<<30) {
+		t.Fatal("fresh keys need a rekey")
+	}
+	if !initiator.NeedsRekey(time.Nanosecond, 0) {
+		t.Fatal("expired keys do not need a rekey")
+	}
+	mustOpen(t, responder, mustSeal(t, initiator, "0123456789"), "0123456789")
+	if !initiator.NeedsRekey(0, 10) {
+		t.Fatal("keys past the byte limit do not need a rekey")
+	}
+
+	// Not while our own request is in flight
+	epoch, ephemeral, err := initiator.StartRekey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if initiator.NeedsRekey(time.Nanosecond, 0) {
+		t.Fatal("rekey needed while a request is in flight")
+	}
+
+	// Nor while answered keys wait for the peer's confirmation
+	response, err := responder.HandleRekeyInit(epoch, ephemeral)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responder.NeedsRekey(time.Nanosecond, 0) {
+		t.Fatal("rekey needed while answered keys await confirmation")
+	}
+
+	if err := initiator.HandleRekeyResponse(epoch, response); err != nil {
+		t.Fatal(err)
+	}
+	mustOpen(t, responder, mustSeal(t, initiator, "confirm"), "confirm")
+	if responder.NeedsRekey(time.Hour, 0) {
+		t.Fatal("confirmed keys need a rekey")
+	}
+}
+
+func TestKeyringDestroy(t *testing.T) {
+	initiator, responder := newKeyringPair(t)
+	ciphertext := mustSeal(t, initiator, "data")
+
+	initiator.Destroy()
+	responder.Destroy()
+	if _, err := initiator.Encrypt([]byte("data"), nil); !errors.Is(err, ErrSessionDestroyed) {
+		t.Fatalf("encrypt: err = %v, want ErrSessionDestroyed", err)
+	}
+	if _, err := responder.Decrypt(ciphertext, nil); !errors.Is(err, ErrSessionDestroyed) {
+		t.Fatalf("decrypt: err = %v, want ErrSessionDestroyed", err)
+	}
+	if responder.secret != [32]byte{} {
+		t.Fatal("rekey secret not wiped")
+	}
+}
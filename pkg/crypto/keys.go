@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeySize is the size of X25519 keys and pre-shared keys
+const KeySize = 32
+
+// NewKeyPair builds a key pair from an existing private key
+func NewKeyPair(privateKey [32]byte) *KeyPair {
+	kp := &KeyPair{PrivateKey: privateKey}
+
+	// Clamp private key for X25519
+	kp.PrivateKey[0] &= 248
+	kp.PrivateKey[31] &= 127
+	kp.PrivateKey[31] |= 64
+
+	curve25519.ScalarBaseMult(&kp.PublicKey, &kp.PrivateKey)
+	return kp
+}
+
+// GeneratePresharedKey generates a random symmetric pre-shared key
+func GeneratePresharedKey() ([32]byte, error) {
+	var psk [32]byte
+	b, err := GenerateRandomBytes(KeySize)
+	if err != nil {
+		return psk, err
+	}
+	copy(psk[:], b)
+	return psk, nil
+}
+
+// EncodeKey encodes a key as standard base64, the same format WireGuard uses
+func EncodeKey(key [32]byte) string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// ParseKey decodes a base64 encoded key
+func ParseKey(s string) ([32]byte, error) {
+	data := []byte(strings.TrimSpace(s))
+	defer clear(data)
+	return parseKey(data)
+}
+
+// parseKey decodes a base64 encoded key, wiping the decoded copy
+func parseKey(data []byte) ([32]byte, error) {
+	var key [32]byte
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	defer clear(b)
+	n, err := base64.StdEncoding.Decode(b, data)
+	if err != nil {
+		return key, fmt.Errorf("invalid key encoding: %w", err)
+	}
+	if n != KeySize {
+		return key, fmt.Errorf("invalid key length: %d", n)
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// readKeyFile reads a base64 encoded key from a file. The file contents
+// are wiped once the key has been decoded.
+func readKeyFile(path string) ([32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer clear(data)
+	key, err := parseKey(bytes.TrimSpace(data))
+	if err != nil {
+		return key, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// LoadKeyPair reads a base64 encoded private key from a file
+func LoadKeyPair(path string) (*KeyPair, error) {
+	privateKey, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(privateKey[:])
+	return NewKeyPair(privateKey), nil
+}
+
+// LoadPresharedKey reads a base64 encoded pre-shared key from a file
+func LoadPresharedKey(path string) ([32]byte, error) {
+	return readKeyFile(path)
+}
+
+// SaveKeyPair writes the private key to a new file readable only by the
+// owner. An existing file is only replaced if overwrite is set.
+func SaveKeyPair(path string, kp *KeyPair, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return err
+	}
+	// Tighten the mode of a replaced file too
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	buf := make([]byte, 0, base64.StdEncoding.EncodedLen(KeySize)+1)
+	buf = append(base64.StdEncoding.AppendEncode(buf, kp.PrivateKey[:]), '\n')
+	defer clear(buf)
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadOrCreateKeyPair loads the private key from path, generating and
+// saving a new one if the file does not exist yet
+func LoadOrCreateKeyPair(path string) (kp *KeyPair, created bool, err error) {
+	kp, err = LoadKeyPair(path)
+	if err == nil {
+		return kp, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+
+	kp, err = GenerateKeyPair()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := SaveKeyPair(path, kp, false); err != nil {
+		return nil, false, err
+	}
+	return kp, true, nil
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveKeyPairDoesNotOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+	first, second := newTestKeyPair(t), newTestKeyPair(t)
+
+	if err := SaveKeyPair(path, first, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeyPair(path, second, false); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("err = %v, want os.ErrExist", err)
+	}
+	loaded, err := LoadKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PublicKey != first.PublicKey {
+		t.Fatal("existing key was replaced")
+	}
+
+	if err := SaveKeyPair(path, second, true); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadKeyPair(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.PublicKey != second.PublicKey {
+		t.Fatal("key was not replaced with overwrite set")
+	}
+}
+
+func TestSaveKeyPairMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.key")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveKeyPair(path, newTestKeyPair(t), true); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("mode = %o, want 600", mode)
+	}
+}
+
+func TestLoadKeyFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"not base64", "not a key!\n"},
+		{"short key", EncodeKey([32]byte{1})[:20] + "\n"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.contents), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyPair(path); err == nil {
+				t.Fatal("loaded an invalid key file")
+			}
+			if _, err := LoadPresharedKey(path); err == nil {
+				t.Fatal("loaded an invalid pre-shared key file")
+			}
+		})
+	}
+}
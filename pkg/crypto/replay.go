@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"math"
+	"sync"
+)
+
+// Replay window constants, following RFC 6479 as used by WireGuard
+const (
+	replayBlockBitLog = 6                      // 1 << 6 == 64 bits per block
+	replayBlockBits   = 1 << replayBlockBitLog // bits in one block
+	replayRingBlocks  = 1 << 5                 // blocks in the ring
+	replayBlockMask   = replayRingBlocks - 1   // ring index mask
+	replayBitMask     = replayBlockBits - 1    // bit index mask
+
+	// ReplayWindowSize is how far behind the highest counter a packet may arrive
+	ReplayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+
+	// RejectAfterMessages is the counter value after which a key must not be used
+	RejectAfterMessages = math.MaxUint64 - (1 << 13)
+)
+
+// ReplayFilter is a sliding bitmap window over received nonce counters.
+// It rejects duplicates and counters that fall behind the window, while
+// still accepting packets reordered within the window.
+type ReplayFilter struct {
+	mu   sync.Mutex
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+// Check reports whether the counter would be accepted, without recording it
+func (f *ReplayFilter) Check(counter uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if counter >= RejectAfterMessages {
+		return false
+	}
+	if counter > f.last {
+		return true
+	}
+	if f.last-counter > ReplayWindowSize {
+		return false
+	}
+
+	indexBlock := (counter >> replayBlockBitLog) & replayBlockMask
+	indexBit := counter & replayBitMask
+	return f.ring[indexBlock]&(1<<indexBit) == 0
+}
+
+// Accept records the counter and reports whether it had not been seen
+// before. It must only be called for authenticated packets.
+func (f *ReplayFilter) Accept(counter uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if counter >= RejectAfterMessages {
+		return false
+	}
+
+	indexBlock := counter >> replayBlockBitLog
+	if counter > f.last {
+		// Move the window forward, clearing the blocks it slides over
+		current := f.last >> replayBlockBitLog
+		diff := indexBlock - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i&replayBlockMask] = 0
+		}
+		f.last = counter
+	} else if f.last-counter > ReplayWindowSize {
+		return false
+	}
+
+	indexBlock &= replayBlockMask
+	indexBit := counter & replayBitMask
+	old := f.ring[indexBlock]
+	f.ring[indexBlock] = old | 1<<indexBit
+	return old&(1<<indexBit) == 0
+}
+
+// Reset clears the window
+func (f *ReplayFilter) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = 0
+	f.ring = [replayRingBlocks]uint64{}
+}
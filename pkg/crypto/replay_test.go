@@ -0,0 +1,124 @@
+package crypto
+
+import "testing"
+
+// replayStep feeds one counter to a filter and states the expected verdict
+type replayStep struct {
+	counter uint64
+	want    bool
+}
+
+func TestReplayFilter(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []replayStep
+	}{
+		{
+			name:  "in order",
+			steps: []replayStep{{0, true}, {1, true}, {2, true}, {3, true}},
+		},
+		{
+			name:  "duplicates",
+			steps: []replayStep{{0, true}, {0, false}, {5, true}, {5, false}, {3, true}, {3, false}},
+		},
+		{
+			name: "out of order inside the window",
+			steps: []replayStep{
+				{10, true}, {7, true}, {9, true}, {8, true}, {0, true},
+				{100, true}, {50, true}, {99, true}, {50, false},
+			},
+		},
+		{
+			name: "window edge",
+			steps: []replayStep{
+				{ReplayWindowSize + 10, true},
+				{10, true}, // Exactly ReplayWindowSize behind
+				{9, false}, // One past the window
+				{11, true},
+				{ReplayWindowSize + 9, true},
+			},
+		},
+		{
+			name: "too old",
+			steps: []replayStep{
+				{5, true}, {5000, true}, {5, false}, {6, false},
+				{5000 - ReplayWindowSize - 1, false},
+			},
+		},
+		{
+			name: "window slides across block boundaries",
+			steps: []replayStep{
+				{62, true}, {63, true}, {64, true}, {65, true},
+				{63, false}, {64, false},
+				{127, true}, {128, true}, {126, true}, {127, false},
+				// Reuse the ring slots of blocks 0-2 for blocks 32-34
+				{34 * replayBlockBits, true},
+				{32*replayBlockBits + 1, true}, {33*replayBlockBits + 63, true},
+				{32*replayBlockBits + 1, false},
+				{62, false}, {65, false}, {128, false},
+			},
+		},
+		{
+			name: "jump further than the ring clears it",
+			steps: []replayStep{
+				{1, true}, {2, true}, {3, true},
+				{1 << 20, true},
+				{1<<20 - 1, true}, {1<<20 - ReplayWindowSize, true},
+				{1 << 20, false}, {3, false},
+			},
+		},
+		{
+			name: "counter limit",
+			steps: []replayStep{
+				{RejectAfterMessages - 2, true},
+				{RejectAfterMessages - 1, true},
+				{RejectAfterMessages, false},
+				{RejectAfterMessages + 1, false},
+				{^uint64(0), false},
+				{RejectAfterMessages - 1, false},
+				{RejectAfterMessages - 3, true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f ReplayFilter
+			for i, step := range tt.steps {
+				if got := f.Check(step.counter); got != step.want {
+					t.Fatalf("step %d: Check(%d) = %v, want %v", i, step.counter, got, step.want)
+				}
+				if got := f.Accept(step.counter); got != step.want {
+					t.Fatalf("step %d: Accept(%d) = %v, want %v", i, step.counter, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayFilterCheckDoesNotRecord(t *testing.T) {
+	var f ReplayFilter
+	for i := 0; i < 2; i++ {
+		if !f.Check(7) {
+			t.Fatal("Check(7) = false before Accept")
+		}
+	}
+	if !f.Accept(7) {
+		t.Fatal("Accept(7) = false")
+	}
+	if f.Check(7) {
+		t.Fatal("Check(7) = true after Accept")
+	}
+}
+
+func TestReplayFilterReset(t *testing.T) {
+	var f ReplayFilter
+	f.Accept(1000)
+	f.Reset()
+	if !f.Accept(1) {
+		t.Fatal("Accept(1) = false after Reset")
+	}
+	if !f.Accept(1000) {
+		t.Fatal("Accept(1000) = false after Reset")
+	}
+}
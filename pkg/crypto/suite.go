@@ -0,0 +1,110 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// CipherSuite identifies the AEAD used for transport data
+type CipherSuite uint8
+
+// Supported cipher suites
+const (
+	CipherSuiteXChaCha20Poly1305 CipherSuite = 0x01
+	CipherSuiteAES256GCM         CipherSuite = 0x02
+)
+
+// ErrUnsupportedCipherSuite is returned for unknown suite identifiers
+var ErrUnsupportedCipherSuite = errors.New("unsupported cipher suite")
+
+// hasAESHardware reports whether AES-GCM runs in constant time with
+// hardware acceleration on this CPU
+var hasAESHardware = (cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ) ||
+	(cpu.ARM64.HasAES && cpu.ARM64.HasPMULL) ||
+	(cpu.S390X.HasAES && cpu.S390X.HasAESGCM)
+
+// DefaultCipherSuites returns the supported suites in preference order.
+// AES-256-GCM comes first only where the CPU accelerates it.
+func DefaultCipherSuites() []CipherSuite {
+	if hasAESHardware {
+		return []CipherSuite{CipherSuiteAES256GCM, CipherSuiteXChaCha20Poly1305}
+	}
+	return []CipherSuite{CipherSuiteXChaCha20Poly1305, CipherSuiteAES256GCM}
+}
+
+// String returns the suite name
+func (s CipherSuite) String() string {
+	switch s {
+	case CipherSuiteXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	case CipherSuiteAES256GCM:
+		return "aes-256-gcm"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// Supported reports whether the suite is implemented
+func (s CipherSuite) Supported() bool {
+	return s == CipherSuiteXChaCha20Poly1305 || s == CipherSuiteAES256GCM
+}
+
+// ParseCipherSuite looks up a suite by name
+func ParseCipherSuite(name string) (CipherSuite, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "xchacha20-poly1305", "xchacha20", "chacha":
+		return CipherSuiteXChaCha20Poly1305, nil
+	case "aes-256-gcm", "aes256gcm", "aes":
+		return CipherSuiteAES256GCM, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedCipherSuite, name)
+	}
+}
+
+// ParseCipherSuites parses a comma separated list of suite names
+func ParseCipherSuites(list string) ([]CipherSuite, error) {
+	var suites []CipherSuite
+	for _, name := range strings.Split(list, ",") {
+		suite, err := ParseCipherSuite(name)
+		if err != nil {
+			return nil, err
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// SelectCipherSuite picks the first suite in the peer's preference order
+// that is also enabled locally
+func SelectCipherSuite(offered, enabled []CipherSuite) (CipherSuite, error) {
+	for _, o := range offered {
+		for _, e := range enabled {
+			if o == e && o.Supported() {
+				return o, nil
+			}
+		}
+	}
+	return 0, ErrUnsupportedCipherSuite
+}
+
+// newAEAD creates the suite's AEAD for a 32 byte key
+func (s CipherSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case CipherSuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	case CipherSuiteAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, ErrUnsupportedCipherSuite
+	}
+}
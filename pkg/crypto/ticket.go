@@ -0,0 +1,66 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Ticket constants
+const (
+	// TicketNonceSize is the size of the random nonce leading each ticket
+	TicketNonceSize = chacha20poly1305.NonceSizeX
+
+	// TicketOverhead is what sealing adds to the ticket contents: nonce + tag
+	TicketOverhead = TicketNonceSize + TagSize
+)
+
+// ErrInvalidTicket is returned for tickets that were not issued by this
+// server to the presenting client
+var ErrInvalidTicket = errors.New("invalid resumption ticket")
+
+// TicketSealer encrypts session resumption tickets under a key that never
+// leaves the server. Each ticket is bound to the static key of the client
+// it was issued to, so a stolen ticket is useless to anyone else.
+// The key lives in memory only: tickets do not survive a server restart.
+type TicketSealer struct {
+	aead cipher.AEAD
+}
+
+// NewTicketSealer creates a sealer with a fresh random key
+func NewTicketSealer() (*TicketSealer, error) {
+	key, err := GenerateRandomBytes(chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer Wipe(key)
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TicketSealer{aead: aead}, nil
+}
+
+// Seal encrypts the ticket contents for the client with the given static key
+func (t *TicketSealer) Seal(contents []byte, clientStatic [32]byte) ([]byte, error) {
+	ticket := make([]byte, TicketNonceSize, TicketOverhead+len(contents))
+	if _, err := rand.Read(ticket); err != nil {
+		return nil, err
+	}
+	return t.aead.Seal(ticket, ticket[:TicketNonceSize], contents, clientStatic[:]), nil
+}
+
+// Open decrypts a ticket presented by the client with the given static key
+func (t *TicketSealer) Open(ticket []byte, clientStatic [32]byte) ([]byte, error) {
+	if len(ticket) < TicketOverhead {
+		return nil, ErrInvalidTicket
+	}
+	contents, err := t.aead.Open(nil, ticket[:TicketNonceSize], ticket[TicketNonceSize:], clientStatic[:])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	return contents, nil
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Batching constants
+const (
+	// BatchEntryHeaderSize is the length(2) in front of every data payload
+	// in a PacketTypeBatch payload
+	BatchEntryHeaderSize = 2
+
+	// BatchDelay is how long a batch waits for more payloads before it is sent
+	BatchDelay = 100 * time.Microsecond
+)
+
+// ErrBatcherStopped is returned by a Batcher after Stop
+var ErrBatcherStopped = errors.New("batcher stopped")
+
+// UnmarshalBatch splits a batch payload into the data payloads it carries.
+// The returned slices alias payload.
+func UnmarshalBatch(payload []byte) ([][]byte, error) {
+	var entries [][]byte
+	for len(payload) > 0 {
+		if len(payload) < BatchEntryHeaderSize {
+			return nil, errors.New("batch entry header too short")
+		}
+		length := int(binary.BigEndian.Uint16(payload))
+		payload = payload[BatchEntryHeaderSize:]
+		if length == 0 || length > len(payload) {
+			return nil, errors.New("invalid batch entry length")
+		}
+		entries = append(entries, payload[:length])
+		payload = payload[length:]
+	}
+	return entries, nil
+}
+
+// Batcher coalesces data payloads into PacketTypeBatch packets, so bulk
+// traffic costs one seal and one transport write per batch instead of per
+// IP packet. A payload that follows a quiet spell of BatchDelay is sent at
+// once, so sparse interactive traffic gains no latency; only payloads that
+// follow each other closely are batched. A batch is sent once nothing more
+// fits or BatchDelay after its first payload; a batch of one goes out as a
+// plain PacketTypeData packet. It is safe for concurrent use.
+type Batcher struct {
+	mu       sync.Mutex
+	headroom int
+	limit    int // Largest payload of a sent packet
+	send     func(buf []byte, packetType uint8) error
+
+	pooled  *[]byte // Buffer of the pending batch, nil if there is none
+	pending []byte  // Headroom followed by the batch payload
+	count   int
+	last    time.Time // When the previous payload was added
+	timer   *time.Timer
+	stopped bool
+}
+
+// NewBatcher creates a batcher for packets with payloads of at most limit
+// bytes. send seals buf[headroom:] and writes it as a packet of the given
+// type; the headroom lets it seal in place. Payloads larger than limit
+// must be sent some other way, such as fragments.
+func NewBatcher(headroom, limit int, send func(buf []byte, packetType uint8) error) *Batcher {
+	b := &Batcher{headroom: headroom, limit: limit, send: send}
+	b.timer = time.AfterFunc(time.Hour, b.flushTimer)
+	b.timer.Stop()
+	return b
+}
+
+// Add queues a data payload, sending the pending batch first if the payload
+// does not fit in it. The payload is copied, so it may be reused. A send
+// error of that earlier batch, or of the payload itself if it is sent at
+// once, is returned.
+func (b *Batcher) Add(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return ErrBatcherStopped
+	}
+	if len(payload) == 0 || len(payload) > b.limit {
+		return errors.New("payload does not fit a batch")
+	}
+
+	now := time.Now()
+	idle := now.Sub(b.last) >= BatchDelay
+	b.last = now
+
+	var err error
+	if b.pooled != nil && b.size()+BatchEntryHeaderSize+len(payload) > b.limit {
+		err = b.flushLocked()
+	}
+	if b.pooled == nil {
+		b.pooled = GetBufferFor(b.headroom + BatchEntryHeaderSize + b.limit)
+		b.pending = (*b.pooled)[:b.headroom]
+		b.timer.Reset(BatchDelay)
+	}
+	b.pending = binary.BigEndian.AppendUint16(b.pending, uint16(len(payload)))
+	b.pending = append(b.pending, payload...)
+	b.count++
+
+	// Send right away after a quiet spell, when no other payload is likely
+	// to follow soon, or once no other payload could join
+	if idle || b.size()+BatchEntryHeaderSize+1 > b.limit {
+		if flushErr := b.flushLocked(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Flush sends the pending batch, if any
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return ErrBatcherStopped
+	}
+	return b.flushLocked()
+}
+
+// Stop discards the pending batch. Nothing is sent after Stop returns.
+func (b *Batcher) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	b.timer.Stop()
+	if b.pooled != nil {
+		PutBuffer(b.pooled)
+		b.pooled, b.pending, b.count = nil, nil, 0
+	}
+}
+
+// flushTimer sends a batch whose BatchDelay has passed. Its send error is
+// dropped; a broken connection also fails the next Add.
+func (b *Batcher) flushTimer() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.stopped {
+		b.flushLocked()
+	}
+}
+
+// flushLocked sends the pending batch with b.mu held
+func (b *Batcher) flushLocked() error {
+	if b.pooled == nil {
+		return nil
+	}
+	b.timer.Stop()
+
+	buf, packetType := b.pending, uint8(PacketTypeBatch)
+	if b.count == 1 {
+		// A batch of one is sent as the data packet it holds
+		buf, packetType = buf[BatchEntryHeaderSize:], PacketTypeData
+	}
+	err := b.send(buf, packetType)
+
+	PutBuffer(b.pooled)
+	b.pooled, b.pending, b.count = nil, nil, 0
+	return err
+}
+
+// size returns the payload size of the pending batch
+func (b *Batcher) size() int {
+	return len(b.pending) - b.headroom
+}
@@ -0,0 +1,211 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// marshalBatch builds a batch payload from its entries
+func marshalBatch(entries ...[]byte) []byte {
+	var buf []byte
+	for _, entry := range entries {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(entry)))
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+func TestUnmarshalBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{name: "empty", payload: nil, want: nil},
+		{name: "one entry", payload: marshalBatch([]byte("one")), want: [][]byte{[]byte("one")}},
+		{
+			name:    "several entries",
+			payload: marshalBatch([]byte("one"), []byte("two"), make([]byte, 1400)),
+			want:    [][]byte{[]byte("one"), []byte("two"), make([]byte, 1400)},
+		},
+		{name: "truncated header", payload: append(marshalBatch([]byte("one")), 0x00), wantErr: true},
+		{name: "truncated entry", payload: marshalBatch([]byte("one"))[:4], wantErr: true},
+		{name: "length past end", payload: []byte{0xff, 0xff, 1, 2, 3}, wantErr: true},
+		{name: "zero length entry", payload: marshalBatch([]byte("one"), nil), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnmarshalBatch(tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %d entries, want error", len(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// sentPacket is a packet a Batcher handed to its send function
+type sentPacket struct {
+	payload    []byte
+	packetType uint8
+}
+
+// recordingBatcher returns a batcher that records what it sends
+func recordingBatcher(limit int) (*Batcher, func() []sentPacket) {
+	const headroom = 8
+	var mu sync.Mutex
+	var sent []sentPacket
+	b := NewBatcher(headroom, limit, func(buf []byte, packetType uint8) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, sentPacket{append([]byte(nil), buf[headroom:]...), packetType})
+		return nil
+	})
+	return b, func() []sentPacket {
+		mu.Lock()
+		defer mu.Unlock()
+		return sent
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	b, sent := recordingBatcher(21)
+	defer b.Stop()
+
+	// A payload after a quiet spell goes out at once, as a plain data packet
+	if err := b.Add([]byte("solo")); err != nil {
+		t.Fatal(err)
+	}
+	if got := sent(); len(got) != 1 {
+		t.Fatalf("sent %v, want the payload at once", got)
+	}
+
+	// Payloads that follow closely are batched, and one that does not fit
+	// sends the pending batch first
+	for _, payload := range []string{"aaaa", "bbbb", "cccc", "dddddddd"} {
+		if err := b.Add([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Nothing more fits after a full batch, so it is sent at once
+	if err := b.Add(make([]byte, 18)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sentPacket{
+		{[]byte("solo"), PacketTypeData},
+		{marshalBatch([]byte("aaaa"), []byte("bbbb"), []byte("cccc")), PacketTypeBatch},
+		{[]byte("dddddddd"), PacketTypeData},
+		{make([]byte, 18), PacketTypeData},
+	}
+	if got := sent(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sent %v, want %v", got, want)
+	}
+}
+
+func TestBatcherSendsAfterQuietSpell(t *testing.T) {
+	b, sent := recordingBatcher(1400)
+	defer b.Stop()
+
+	// Sparse payloads never wait for a batch to fill
+	for round := 1; round <= 3; round++ {
+		if err := b.Add([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := sent()
+		if len(got) != round {
+			t.Fatalf("round %d: payload not sent at once", round)
+		}
+		if got[round-1].packetType != PacketTypeData {
+			t.Fatalf("round %d: sent packet type %d, want data", round, got[round-1].packetType)
+		}
+		time.Sleep(2 * BatchDelay)
+	}
+}
+
+func TestBatcherFlushesAfterDelay(t *testing.T) {
+	b, sent := recordingBatcher(1400)
+	defer b.Stop()
+
+	// The first payload of a burst goes out at once, the rest are batched
+	for _, payload := range []string{"first", "one", "two"} {
+		if err := b.Add([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(sent()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("batch not sent after BatchDelay")
+		}
+		time.Sleep(BatchDelay)
+	}
+	if got := sent(); len(got) != 2 || !bytes.Equal(got[1].payload, marshalBatch([]byte("one"), []byte("two"))) {
+		t.Fatalf("sent %v", got)
+	}
+}
+
+func TestBatcherRejects(t *testing.T) {
+	b, sent := recordingBatcher(16)
+	if err := b.Add(nil); err == nil {
+		t.Fatal("empty payload accepted")
+	}
+	if err := b.Add(make([]byte, 17)); err == nil {
+		t.Fatal("payload over the limit accepted")
+	}
+
+	// The first payload is sent at once, the second waits for more
+	if err := b.Add([]byte("sent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add([]byte("pending")); err != nil {
+		t.Fatal(err)
+	}
+	b.Stop()
+	if err := b.Add([]byte("late")); err != ErrBatcherStopped {
+		t.Fatalf("Add after Stop: err = %v, want ErrBatcherStopped", err)
+	}
+	if err := b.Flush(); err != ErrBatcherStopped {
+		t.Fatalf("Flush after Stop: err = %v, want ErrBatcherStopped", err)
+	}
+	time.Sleep(2 * BatchDelay)
+	if got := sent(); len(got) != 1 {
+		t.Fatalf("sent %v after Stop", got)
+	}
+}
+
+func FuzzUnmarshalBatch(f *testing.F) {
+	f.Add(marshalBatch([]byte("one"), []byte("two")))
+	f.Add([]byte{0x00, 0x00})
+	f.Add([]byte{0xff, 0xff, 0x01})
+	f.Add([]byte{0x00})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		entries, err := UnmarshalBatch(payload)
+		if err != nil {
+			return
+		}
+		// A valid batch is exactly its entries, so it marshals back unchanged
+		for _, entry := range entries {
+			if len(entry) == 0 {
+				t.Fatal("empty entry")
+			}
+		}
+		if !bytes.Equal(marshalBatch(entries...), payload) {
+			t.Fatal("entries do not marshal back to the payload")
+		}
+	})
+}
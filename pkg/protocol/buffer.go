@@ -0,0 +1,50 @@
+package protocol
+
+import "sync"
+
+// BufferSize is the size of pooled packet buffers. It holds any packet
+// read from a transport or TUN device plus the header and crypto overhead.
+const BufferSize = 4096
+
+// LargeBufferSize is the size of pooled buffers for TUN devices whose MTU
+// does not fit BufferSize. It holds the largest possible packet.
+const LargeBufferSize = HeaderSize + MaxPacketSize
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, BufferSize)
+		return &b
+	},
+}
+
+var largeBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, LargeBufferSize)
+		return &b
+	},
+}
+
+// GetBuffer returns a BufferSize byte buffer from the pool
+func GetBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// GetBufferFor returns a pooled buffer of at least n bytes, or of
+// LargeBufferSize bytes if n is larger still
+func GetBufferFor(n int) *[]byte {
+	if n <= BufferSize {
+		return GetBuffer()
+	}
+	return largeBufferPool.Get().(*[]byte)
+}
+
+// PutBuffer returns a buffer obtained from GetBuffer or GetBufferFor to the pool
+func PutBuffer(b *[]byte) {
+	if cap(*b) >= LargeBufferSize {
+		*b = (*b)[:LargeBufferSize]
+		largeBufferPool.Put(b)
+		return
+	}
+	*b = (*b)[:BufferSize]
+	bufferPool.Put(b)
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Compression methods. With CapabilityCompression every data payload
+// starts with the method, followed by the IP packet, and is padded after
+// compression.
+const (
+	CompressionNone    = 0x00 // Packet follows as is
+	CompressionDeflate = 0x01 // Packet follows DEFLATE compressed
+
+	// CompressionHeaderSize is the method(1) in front of a compressed payload
+	CompressionHeaderSize = 1
+)
+
+// CompressionStats counts the data packets that went through a Compressor
+// or Decompressor
+type CompressionStats struct {
+	Packets       uint64 // Data packets seen
+	Compressed    uint64 // Packets that were compressed rather than sent as is
+	OriginalBytes uint64 // IP packet bytes
+	WireBytes     uint64 // Payload bytes on the wire, compression headers included
+}
+
+// Ratio returns wire bytes per original byte, or 1 before any traffic
+func (s CompressionStats) Ratio() float64 {
+	if s.OriginalBytes == 0 {
+		return 1
+	}
+	return float64(s.WireBytes) / float64(s.OriginalBytes)
+}
+
+// compressionCounters backs CompressionStats, readable while packets flow
+type compressionCounters struct {
+	packets    atomic.Uint64
+	compressed atomic.Uint64
+	original   atomic.Uint64
+	wire       atomic.Uint64
+}
+
+// add records one packet
+func (c *compressionCounters) add(original, wire int, compressed bool) {
+	c.packets.Add(1)
+	if compressed {
+		c.compressed.Add(1)
+	}
+	c.original.Add(uint64(original))
+	c.wire.Add(uint64(wire))
+}
+
+// stats returns a snapshot of the counters
+func (c *compressionCounters) stats() CompressionStats {
+	return CompressionStats{
+		Packets:       c.packets.Load(),
+		Compressed:    c.compressed.Load(),
+		OriginalBytes: c.original.Load(),
+		WireBytes:     c.wire.Load(),
+	}
+}
+
+// Compressor compresses data payloads one packet at a time, so each can
+// be decompressed on its own. Methods other than Stats are not safe for
+// concurrent use.
+type Compressor struct {
+	w        *flate.Writer
+	out      bytes.Buffer
+	counters compressionCounters
+}
+
+// NewCompressor creates a DEFLATE compressor tuned for speed
+func NewCompressor() *Compressor {
+	c := &Compressor{}
+	c.w, _ = flate.NewWriter(&c.out, flate.BestSpeed)
+	return c
+}
+
+// Compress compresses the packet in payload[CompressionHeaderSize:] in
+// place and fills in the header. Packets that do not shrink are left as
+// they are. The result aliases payload and is never longer.
+func (c *Compressor) Compress(payload []byte) []byte {
+	packet := payload[CompressionHeaderSize:]
+	c.out.Reset()
+	c.w.Reset(&c.out)
+	c.w.Write(packet)
+	c.w.Close()
+
+	if c.out.Len() >= len(packet) {
+		payload[0] = CompressionNone
+		c.counters.add(len(packet), len(payload), false)
+		return payload
+	}
+	payload[0] = CompressionDeflate
+	n := copy(packet, c.out.Bytes())
+	c.counters.add(len(packet), CompressionHeaderSize+n, true)
+	return payload[:CompressionHeaderSize+n]
+}
+
+// Stats returns what the compressor has done so far
+func (c *Compressor) Stats() CompressionStats {
+	return c.counters.stats()
+}
+
+// Decompressor reverses a Compressor. Methods other than Stats are not
+// safe for concurrent use.
+type Decompressor struct {
+	r        io.ReadCloser
+	src      bytes.Reader
+	out      bytes.Buffer
+	counters compressionCounters
+}
+
+// NewDecompressor creates a DEFLATE decompressor
+func NewDecompressor() *Decompressor {
+	d := &Decompressor{}
+	d.r = flate.NewReader(&d.src)
+	return d
+}
+
+// Decompress returns the IP packet of a payload made by Compress. The
+// result aliases payload or a buffer reused by the next call.
+func (d *Decompressor) Decompress(payload []byte) ([]byte, error) {
+	if len(payload) < CompressionHeaderSize {
+		return nil, errors.New("compressed payload too short")
+	}
+	data := payload[CompressionHeaderSize:]
+
+	switch payload[0] {
+	case CompressionNone:
+		d.counters.add(len(data), len(payload), false)
+		return data, nil
+
+	case CompressionDeflate:
+		d.src.Reset(data)
+		if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+			return nil, err
+		}
+		d.out.Reset()
+
+		// Bound the output, so a small payload cannot inflate without limit
+		n, err := d.out.ReadFrom(io.LimitReader(d.r, MaxPacketSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompress: %w", err)
+		}
+		if n > MaxPacketSize {
+			return nil, errors.New("decompressed packet too large")
+		}
+		d.counters.add(int(n), len(payload), true)
+		return d.out.Bytes(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown compression method %d", payload[0])
+	}
+}
+
+// Stats returns what the decompressor has done so far
+func (d *Decompressor) Stats() CompressionStats {
+	return d.counters.stats()
+}
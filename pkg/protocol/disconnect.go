@@ -0,0 +1,81 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Disconnect reasons
+const (
+	DisconnectNormal        = 0x00 // Peer closed the session, or acknowledges a disconnect
+	DisconnectShutdown      = 0x01 // Server is shutting down
+	DisconnectPoolExhausted = 0x02 // Server has no tunnel address left for the client
+	DisconnectKeyRejected   = 0x03 // Client key is no longer accepted; reconnecting is pointless
+
+	// DisconnectMessageSize is reason(1) + retry after in seconds(2)
+	DisconnectMessageSize = 3
+
+	// CloseTimeout is how long the side closing a session waits for the
+	// peer to acknowledge its disconnect before dropping the connection
+	CloseTimeout = 2 * time.Second
+)
+
+// DisconnectMessage is carried by encrypted PacketTypeDisconnect packets.
+// An empty payload, as sent by older peers, is a DisconnectNormal without
+// a retry hint.
+type DisconnectMessage struct {
+	Reason     uint8
+	RetryAfter time.Duration // Earliest sensible reconnect, zero for no hint; whole seconds on the wire
+}
+
+// Permanent reports whether the client should give up instead of reconnecting
+func (m *DisconnectMessage) Permanent() bool {
+	return m.Reason == DisconnectKeyRejected
+}
+
+// String returns a short description of the disconnect
+func (m *DisconnectMessage) String() string {
+	var reason string
+	switch m.Reason {
+	case DisconnectNormal:
+		reason = "closed by peer"
+	case DisconnectShutdown:
+		reason = "server shutting down"
+	case DisconnectPoolExhausted:
+		reason = "address pool exhausted"
+	case DisconnectKeyRejected:
+		reason = "key rejected"
+	default:
+		reason = fmt.Sprintf("unknown reason %d", m.Reason)
+	}
+	if m.RetryAfter > 0 {
+		reason += fmt.Sprintf(", retry after %v", m.RetryAfter)
+	}
+	return reason
+}
+
+// MarshalDisconnectMessage serializes a disconnect message
+func MarshalDisconnectMessage(m *DisconnectMessage) []byte {
+	buf := make([]byte, DisconnectMessageSize)
+	buf[0] = m.Reason
+	binary.BigEndian.PutUint16(buf[1:3], uint16(min(m.RetryAfter/time.Second, 0xffff)))
+	return buf
+}
+
+// UnmarshalDisconnectMessage deserializes a disconnect message
+func UnmarshalDisconnectMessage(data []byte) (*DisconnectMessage, error) {
+	if len(data) == 0 {
+		return &DisconnectMessage{Reason: DisconnectNormal}, nil
+	}
+	if len(data) < DisconnectMessageSize {
+		return nil, errors.New("disconnect message too short")
+	}
+
+	m := &DisconnectMessage{}
+	m.Reason = data[0]
+	m.RetryAfter = time.Duration(binary.BigEndian.Uint16(data[1:3])) * time.Second
+
+	return m, nil
+}
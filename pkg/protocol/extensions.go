@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Extension types of the TLV block the server pushes in the handshake
+// response. Each entry is type(1) + length(2) + value. List-valued settings
+// use one entry per item, and clients skip types they do not know.
+const (
+	ExtensionDNS          = 0x01 // DNS server: 4 or 16 byte address
+	ExtensionSearchDomain = 0x02 // DNS search domain
+	ExtensionRoute        = 0x03 // Route to install: 4 or 16 byte address + prefix length(1)
+	ExtensionMTU          = 0x04 // Tunnel MTU: uint16
+	ExtensionKeepAlive    = 0x05 // Keepalive interval in seconds: uint16
+
+	// extensionHeaderSize is type(1) + length(2)
+	extensionHeaderSize = 3
+
+	// MaxExtensionsSize bounds the extension block of a handshake response
+	MaxExtensionsSize = 4096
+
+	// maxDomainLength is the longest domain name in text form
+	maxDomainLength = 253
+
+	// MinMTU is the smallest tunnel MTU every IPv4 host must handle
+	MinMTU = 576
+
+	// MinMTU6 is the smallest tunnel MTU IPv6 allows, for dual-stack sessions
+	MinMTU6 = 1280
+)
+
+// ClientConfig is the network configuration the server pushes to clients.
+// Zero values mean the client keeps its own defaults.
+type ClientConfig struct {
+	DNS           []net.IP
+	SearchDomains []string
+	Routes        []*net.IPNet // Routed through the tunnel; all traffic if empty
+	MTU           uint16
+	KeepAlive     time.Duration // Rounded down to whole seconds on the wire
+}
+
+// MarshalClientConfig serializes a client configuration as a TLV extension block
+func MarshalClientConfig(c *ClientConfig) ([]byte, error) {
+	var buf []byte
+	var err error
+	for _, ip := range c.DNS {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if buf, err = appendExtension(buf, ExtensionDNS, ip); err != nil {
+			return nil, err
+		}
+	}
+	for _, domain := range c.SearchDomains {
+		if !ValidSearchDomain(domain) {
+			return nil, fmt.Errorf("invalid search domain %q", domain)
+		}
+		if buf, err = appendExtension(buf, ExtensionSearchDomain, []byte(domain)); err != nil {
+			return nil, err
+		}
+	}
+	for _, route := range c.Routes {
+		ip := route.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ones, _ := route.Mask.Size()
+		value := append(append([]byte(nil), ip...), uint8(ones))
+		if buf, err = appendExtension(buf, ExtensionRoute, value); err != nil {
+			return nil, err
+		}
+	}
+	if c.MTU != 0 {
+		buf, err = appendExtension(buf, ExtensionMTU, binary.BigEndian.AppendUint16(nil, c.MTU))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if seconds := c.KeepAlive / time.Second; seconds > 0 {
+		if seconds > 0xffff {
+			return nil, errors.New("keepalive interval too long")
+		}
+		buf, err = appendExtension(buf, ExtensionKeepAlive, binary.BigEndian.AppendUint16(nil, uint16(seconds)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(buf) > MaxExtensionsSize {
+		return nil, errors.New("extension block too large")
+	}
+	return buf, nil
+}
+
+// appendExtension appends one TLV entry to buf
+func appendExtension(buf []byte, extType uint8, value []byte) ([]byte, error) {
+	if len(value) > 0xffff {
+		return nil, errors.New("extension value too large")
+	}
+	buf = append(buf, extType)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(value)))
+	return append(buf, value...), nil
+}
+
+// UnmarshalClientConfig deserializes a TLV extension block. Unknown
+// extension types are skipped so servers can add settings without breaking
+// older clients.
+func UnmarshalClientConfig(data []byte) (*ClientConfig, error) {
+	c := &ClientConfig{}
+	for len(data) > 0 {
+		if len(data) < extensionHeaderSize {
+			return nil, errors.New("extension header too short")
+		}
+		extType := data[0]
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < extensionHeaderSize+length {
+			return nil, errors.New("extension value too short")
+		}
+		value := data[extensionHeaderSize : extensionHeaderSize+length]
+		data = data[extensionHeaderSize+length:]
+
+		switch extType {
+		case ExtensionDNS:
+			if length != net.IPv4len && length != net.IPv6len {
+				return nil, errors.New("invalid DNS server extension")
+			}
+			c.DNS = append(c.DNS, net.IP(append([]byte(nil), value...)))
+		case ExtensionSearchDomain:
+			// Domains end up on the command line of resolver tools
+			if !ValidSearchDomain(string(value)) {
+				return nil, errors.New("invalid search domain extension")
+			}
+			c.SearchDomains = append(c.SearchDomains, string(value))
+		case ExtensionRoute:
+			size := length - 1
+			if size != net.IPv4len && size != net.IPv6len {
+				return nil, errors.New("invalid route extension")
+			}
+			addr, _ := netip.AddrFromSlice(value[:size])
+			prefix := netip.PrefixFrom(addr, int(value[size]))
+			if !prefix.IsValid() {
+				return nil, errors.New("invalid route extension")
+			}
+			prefix = prefix.Masked()
+			c.Routes = append(c.Routes, &net.IPNet{
+				IP:   net.IP(prefix.Addr().AsSlice()),
+				Mask: net.CIDRMask(prefix.Bits(), size*8),
+			})
+		case ExtensionMTU:
+			if length != 2 {
+				return nil, errors.New("invalid MTU extension")
+			}
+			c.MTU = binary.BigEndian.Uint16(value)
+			if c.MTU < MinMTU {
+				return nil, fmt.Errorf("MTU extension %d below the minimum of %d", c.MTU, MinMTU)
+			}
+		case ExtensionKeepAlive:
+			if length != 2 {
+				return nil, errors.New("invalid keepalive extension")
+			}
+			c.KeepAlive = time.Duration(binary.BigEndian.Uint16(value)) * time.Second
+		}
+	}
+	return c, nil
+}
+
+// ValidSearchDomain reports whether domain is a sequence of hostname labels:
+// letters, digits and inner hyphens, 1-63 characters each. Anything else,
+// such as a leading '-' that a command would take for a flag, is rejected.
+func ValidSearchDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > maxDomainLength {
+		return false
+	}
+	label := 0
+	for i := 0; i < len(domain); i++ {
+		ch := domain[i]
+		switch {
+		case ch == '.':
+			if label == 0 || domain[i-1] == '-' {
+				return false
+			}
+			label = 0
+			continue
+		case ch == '-':
+			if label == 0 {
+				return false
+			}
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		default:
+			return false
+		}
+		if label++; label > 63 {
+			return false
+		}
+	}
+	return label > 0 && domain[len(domain)-1] != '-'
+}
@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// extension builds one TLV entry
+func extension(extType uint8, value ...byte) []byte {
+	buf, err := appendExtension(nil, extType, value)
+	if err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+// concat joins TLV entries into an extension block
+func concat(entries ...[]byte) []byte {
+	var buf []byte
+	for _, entry := range entries {
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, route, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return route
+}
+
+func TestClientConfigRoundTrip(t *testing.T) {
+	want := &ClientConfig{
+		DNS:           []net.IP{net.ParseIP("10.8.0.1").To4(), net.ParseIP("fd00::1")},
+		SearchDomains: []string{"corp.example.com", "lab"},
+		Routes:        []*net.IPNet{mustParseCIDR("10.0.0.0/8"), mustParseCIDR("fd00::/64")},
+		MTU:           1380,
+		KeepAlive:     15 * time.Second,
+	}
+	data, err := MarshalClientConfig(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalClientConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	empty, err := MarshalClientConfig(&ClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) != 0 {
+		t.Fatalf("empty config marshaled to %d bytes", len(empty))
+	}
+}
+
+func TestUnmarshalClientConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    *ClientConfig
+		wantErr bool
+	}{
+		{
+			name: "unknown types skipped",
+			data: concat(extension(0xee, 1, 2, 3), extension(ExtensionMTU, 0x05, 0x00), extension(0xff)),
+			want: &ClientConfig{MTU: 1280},
+		},
+		{
+			name: "duplicate list entries accumulate",
+			data: concat(extension(ExtensionSearchDomain, []byte("a.example")...), extension(ExtensionSearchDomain, []byte("a.example")...)),
+			want: &ClientConfig{SearchDomains: []string{"a.example", "a.example"}},
+		},
+		{
+			name: "duplicate settings keep the last",
+			data: concat(extension(ExtensionMTU, 0x05, 0x00), extension(ExtensionMTU, 0x05, 0x78)),
+			want: &ClientConfig{MTU: 1400},
+		},
+		{
+			name: "smallest MTU",
+			data: extension(ExtensionMTU, 0x02, 0x40),
+			want: &ClientConfig{MTU: MinMTU},
+		},
+		{
+			name: "route masked to its prefix",
+			data: extension(ExtensionRoute, 10, 1, 2, 3, 16),
+			want: &ClientConfig{Routes: []*net.IPNet{mustParseCIDR("10.1.0.0/16")}},
+		},
+		{name: "truncated header", data: []byte{ExtensionMTU, 0x00}, wantErr: true},
+		{name: "truncated value", data: []byte{ExtensionMTU, 0x00, 0x02, 0x05}, wantErr: true},
+		{name: "truncated after valid entry", data: concat(extension(ExtensionMTU, 0x05, 0x00), []byte{0x01}), wantErr: true},
+		{name: "short DNS server", data: extension(ExtensionDNS, 10, 0, 0), wantErr: true},
+		{name: "empty route", data: extension(ExtensionRoute), wantErr: true},
+		{name: "route prefix too long", data: extension(ExtensionRoute, 10, 0, 0, 0, 33), wantErr: true},
+		{name: "short MTU", data: extension(ExtensionMTU, 0x05), wantErr: true},
+		{name: "MTU below minimum", data: extension(ExtensionMTU, 0x02, 0x3f), wantErr: true},
+		{name: "zero MTU", data: extension(ExtensionMTU, 0x00, 0x00), wantErr: true},
+		{name: "long keepalive", data: extension(ExtensionKeepAlive, 0, 0, 15), wantErr: true},
+		{name: "search domain flag", data: extension(ExtensionSearchDomain, []byte("--help")...), wantErr: true},
+		{name: "search domain with space", data: extension(ExtensionSearchDomain, []byte("a b")...), wantErr: true},
+		{name: "empty search domain", data: extension(ExtensionSearchDomain), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := UnmarshalClientConfig(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalClientConfigRejectsInvalidDomain(t *testing.T) {
+	if _, err := MarshalClientConfig(&ClientConfig{SearchDomains: []string{"-x.example"}}); err == nil {
+		t.Fatal("marshaled a search domain starting with '-'")
+	}
+}
+
+func TestValidSearchDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"corp", true},
+		{"a-b.c-d.example", true},
+		{"xn--bcher-kva.example", true},
+		{"123.example", true},
+		{"", false},
+		{"-v", false},
+		{"a.-b", false},
+		{"a-.b", false},
+		{"a..b", false},
+		{".example", false},
+		{"example.", false},
+		{"exa mple", false},
+		{"exa_mple", false},
+		{"a;reboot", false},
+		{string(make([]byte, 64)), false},
+	}
+	for _, tt := range tests {
+		if got := ValidSearchDomain(tt.domain); got != tt.want {
+			t.Errorf("ValidSearchDomain(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+
+	label := "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyzabcdefghijk"
+	if !ValidSearchDomain(label) {
+		t.Error("63 character label rejected")
+	}
+	if ValidSearchDomain(label + "l") {
+		t.Error("64 character label accepted")
+	}
+	long := label + "." + label + "." + label + "." + label
+	if ValidSearchDomain(long) {
+		t.Errorf("%d character domain accepted", len(long))
+	}
+}
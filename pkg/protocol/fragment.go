@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Fragmentation constants
+const (
+	// FragmentHeaderSize is id(4) + index(1) + count(1)
+	FragmentHeaderSize = 6
+
+	// MaxFragments is the most fragments one packet is split into
+	MaxFragments = 255
+
+	// ReassemblyTimeout is how long the fragments of an incomplete packet
+	// are kept
+	ReassemblyTimeout = 5 * time.Second
+
+	// MaxPendingReassemblies bounds the packets being reassembled at once;
+	// the oldest is dropped to make room for a new one
+	MaxPendingReassemblies = 16
+)
+
+// ErrFragmentTooSmall is returned when the fragment size leaves no room for data
+var ErrFragmentTooSmall = errors.New("fragment size too small")
+
+// FragmentHeader precedes the data of every PacketTypeFragment payload
+type FragmentHeader struct {
+	ID    uint32 // Shared by all fragments of a packet
+	Index uint8
+	Count uint8
+}
+
+// Fragment splits payload into fragment payloads of at most size bytes,
+// header included. Each one is then sealed as a PacketTypeFragment packet.
+func Fragment(id uint32, payload []byte, size int) ([][]byte, error) {
+	chunk := size - FragmentHeaderSize
+	if chunk <= 0 {
+		return nil, ErrFragmentTooSmall
+	}
+	count := (len(payload) + chunk - 1) / chunk
+	if count > MaxFragments {
+		return nil, errors.New("payload needs too many fragments")
+	}
+
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		data := payload[i*chunk : min((i+1)*chunk, len(payload))]
+		buf := make([]byte, FragmentHeaderSize+len(data))
+		binary.BigEndian.PutUint32(buf[0:4], id)
+		buf[4] = uint8(i)
+		buf[5] = uint8(count)
+		copy(buf[FragmentHeaderSize:], data)
+		fragments = append(fragments, buf)
+	}
+	return fragments, nil
+}
+
+// UnmarshalFragment splits a fragment payload into its header and data
+func UnmarshalFragment(payload []byte) (FragmentHeader, []byte, error) {
+	if len(payload) < FragmentHeaderSize {
+		return FragmentHeader{}, nil, errors.New("fragment too short")
+	}
+	h := FragmentHeader{
+		ID:    binary.BigEndian.Uint32(payload[0:4]),
+		Index: payload[4],
+		Count: payload[5],
+	}
+	if h.Count == 0 || h.Index >= h.Count {
+		return FragmentHeader{}, nil, errors.New("invalid fragment index")
+	}
+	return h, payload[FragmentHeaderSize:], nil
+}
+
+// Reassembler puts fragmented packets back together. It keeps at most
+// MaxPendingReassemblies incomplete packets of at most MaxPacketSize bytes,
+// each for at most ReassemblyTimeout. It is not safe for concurrent use.
+type Reassembler struct {
+	pending map[uint32]*reassembly
+}
+
+// reassembly collects the fragments of one packet
+type reassembly struct {
+	fragments [][]byte
+	received  int
+	size      int
+	started   time.Time
+}
+
+// NewReassembler creates an empty reassembler
+func NewReassembler() *Reassembler {
+	return &Reassembler{pending: make(map[uint32]*reassembly)}
+}
+
+// Add takes a fragment payload and returns the complete packet once its
+// last fragment arrives, or nil while fragments are missing. The fragment
+// data is copied, so payload may be reused.
+func (r *Reassembler) Add(payload []byte) ([]byte, error) {
+	h, data, err := UnmarshalFragment(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	r.expire(now)
+
+	ra, ok := r.pending[h.ID]
+	if !ok {
+		if len(r.pending) >= MaxPendingReassemblies {
+			r.evictOldest()
+		}
+		ra = &reassembly{fragments: make([][]byte, h.Count), started: now}
+		r.pending[h.ID] = ra
+	}
+	if int(h.Count) != len(ra.fragments) {
+		delete(r.pending, h.ID)
+		return nil, errors.New("fragment count mismatch")
+	}
+	if ra.fragments[h.Index] != nil {
+		return nil, errors.New("duplicate fragment")
+	}
+	if ra.size+len(data) > MaxPacketSize {
+		delete(r.pending, h.ID)
+		return nil, errors.New("reassembled packet too large")
+	}
+
+	ra.fragments[h.Index] = append([]byte(nil), data...)
+	ra.received++
+	ra.size += len(data)
+	if ra.received < len(ra.fragments) {
+		return nil, nil
+	}
+
+	delete(r.pending, h.ID)
+	packet := make([]byte, 0, ra.size)
+	for _, fragment := range ra.fragments {
+		packet = append(packet, fragment...)
+	}
+	return packet, nil
+}
+
+// expire drops incomplete packets older than ReassemblyTimeout
+func (r *Reassembler) expire(now time.Time) {
+	for id, ra := range r.pending {
+		if now.Sub(ra.started) > ReassemblyTimeout {
+			delete(r.pending, id)
+		}
+	}
+}
+
+// evictOldest drops the incomplete packet that has waited longest
+func (r *Reassembler) evictOldest() {
+	var oldestID uint32
+	var oldest *reassembly
+	for id, ra := range r.pending {
+		if oldest == nil || ra.started.Before(oldest.started) {
+			oldestID, oldest = id, ra
+		}
+	}
+	delete(r.pending, oldestID)
+}
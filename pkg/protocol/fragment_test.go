@@ -0,0 +1,216 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+// fragmentPayload builds a fragment payload from its header fields
+func fragmentPayload(id uint32, index, count uint8, data string) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, id)
+	buf = append(buf, index, count)
+	return append(buf, data...)
+}
+
+// reassemble feeds fragments to r and returns the packet they complete
+func reassemble(t *testing.T, r *Reassembler, fragments [][]byte) []byte {
+	t.Helper()
+	var packet []byte
+	for i, fragment := range fragments {
+		out, err := r.Add(fragment)
+		if err != nil {
+			t.Fatalf("fragment %d: %v", i, err)
+		}
+		if out != nil && i != len(fragments)-1 {
+			t.Fatalf("packet complete after %d of %d fragments", i+1, len(fragments))
+		}
+		packet = out
+	}
+	return packet
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	payload := make([]byte, 5000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	for _, size := range []int{FragmentHeaderSize + 20, 100, 1400, 4999, 6000} {
+		fragments, err := Fragment(7, payload, size)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		for _, fragment := range fragments {
+			if len(fragment) > size {
+				t.Fatalf("size %d: %d byte fragment", size, len(fragment))
+			}
+		}
+
+		// Fragments may arrive in any order
+		rand.Shuffle(len(fragments), func(i, j int) {
+			fragments[i], fragments[j] = fragments[j], fragments[i]
+		})
+		r := NewReassembler()
+		if packet := reassemble(t, r, fragments); !bytes.Equal(packet, payload) {
+			t.Fatalf("size %d: reassembled %d bytes, want %d", size, len(packet), len(payload))
+		}
+		if len(r.pending) != 0 {
+			t.Fatalf("size %d: %d reassemblies left", size, len(r.pending))
+		}
+	}
+}
+
+func TestFragmentErrors(t *testing.T) {
+	if _, err := Fragment(1, []byte("data"), FragmentHeaderSize); err != ErrFragmentTooSmall {
+		t.Fatalf("err = %v, want ErrFragmentTooSmall", err)
+	}
+	if _, err := Fragment(1, make([]byte, MaxFragments+1), FragmentHeaderSize+1); err == nil {
+		t.Fatal("split a payload into more than MaxFragments fragments")
+	}
+	if _, err := Fragment(1, make([]byte, MaxFragments), FragmentHeaderSize+1); err != nil {
+		t.Fatalf("MaxFragments fragments: %v", err)
+	}
+}
+
+func TestReassemblerRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments [][]byte // All but the last are accepted
+	}{
+		{name: "truncated header", fragments: [][]byte{{0, 0, 0, 1, 0}}},
+		{name: "zero count", fragments: [][]byte{fragmentPayload(1, 0, 0, "a")}},
+		{name: "index past count", fragments: [][]byte{fragmentPayload(1, 2, 2, "a")}},
+		{name: "duplicate fragment", fragments: [][]byte{
+			fragmentPayload(1, 0, 2, "a"),
+			fragmentPayload(1, 0, 2, "a"),
+		}},
+		{name: "count mismatch", fragments: [][]byte{
+			fragmentPayload(1, 0, 2, "a"),
+			fragmentPayload(1, 1, 3, "b"),
+		}},
+		{name: "packet too large", fragments: [][]byte{
+			fragmentPayload(1, 0, 2, string(make([]byte, MaxPacketSize))),
+			fragmentPayload(1, 1, 2, "b"),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler()
+			last := len(tt.fragments) - 1
+			for i, fragment := range tt.fragments[:last] {
+				if _, err := r.Add(fragment); err != nil {
+					t.Fatalf("fragment %d: %v", i, err)
+				}
+			}
+			if packet, err := r.Add(tt.fragments[last]); err == nil {
+				t.Fatalf("accepted, packet = %q", packet)
+			}
+		})
+	}
+}
+
+func TestReassemblerDropsAbandonedPackets(t *testing.T) {
+	r := NewReassembler()
+	if _, err := r.Add(fragmentPayload(1, 0, 2, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add(fragmentPayload(2, 0, 2, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A mismatched count drops what was collected for the packet
+	if _, err := r.Add(fragmentPayload(2, 1, 3, "b")); err == nil {
+		t.Fatal("count mismatch accepted")
+	}
+	if _, ok := r.pending[2]; ok {
+		t.Fatal("mismatched packet still pending")
+	}
+
+	// Fragments older than ReassemblyTimeout are forgotten
+	r.pending[1].started = time.Now().Add(-ReassemblyTimeout - time.Second)
+	packet, err := r.Add(fragmentPayload(1, 1, 2, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet != nil {
+		t.Fatal("packet completed with an expired fragment")
+	}
+}
+
+func TestReassemblerEvictsOldest(t *testing.T) {
+	r := NewReassembler()
+	for id := uint32(0); id < MaxPendingReassemblies; id++ {
+		if _, err := r.Add(fragmentPayload(id, 0, 2, "a")); err != nil {
+			t.Fatal(err)
+		}
+		r.pending[id].started = time.Now().Add(time.Duration(id) * time.Millisecond)
+	}
+
+	if _, err := r.Add(fragmentPayload(MaxPendingReassemblies, 0, 2, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.pending) != MaxPendingReassemblies {
+		t.Fatalf("%d pending, want %d", len(r.pending), MaxPendingReassemblies)
+	}
+	if _, ok := r.pending[0]; ok {
+		t.Fatal("oldest packet not evicted")
+	}
+
+	// The others still complete
+	packet, err := r.Add(fragmentPayload(1, 1, 2, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(packet) != "ab" {
+		t.Fatalf("reassembled %q, want %q", packet, "ab")
+	}
+}
+
+func FuzzReassembler(f *testing.F) {
+	f.Add(fragmentPayload(1, 0, 1, "whole"))
+	f.Add(append(fragmentPayload(1, 1, 2, "b"), fragmentPayload(1, 0, 2, "a")...))
+	f.Add(append(fragmentPayload(1, 0, 2, "a"), fragmentPayload(1, 0, 3, "b")...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// The input is a series of fragments of up to 255 bytes, each
+		// preceded by its length
+		r := NewReassembler()
+		for len(data) > 0 {
+			n := min(int(data[0]), len(data)-1)
+			fragment := data[1 : 1+n]
+			data = data[1+n:]
+
+			packet, err := r.Add(fragment)
+			if err != nil && packet != nil {
+				t.Fatal("packet returned with an error")
+			}
+			if len(packet) > MaxPacketSize {
+				t.Fatalf("%d byte packet reassembled", len(packet))
+			}
+			if len(r.pending) > MaxPendingReassemblies {
+				t.Fatalf("%d packets pending", len(r.pending))
+			}
+		}
+	})
+}
+
+func FuzzFragment(f *testing.F) {
+	f.Add([]byte("payload"), 8)
+	f.Add(make([]byte, 1500), 1400)
+
+	f.Fuzz(func(t *testing.T, payload []byte, size int) {
+		if len(payload) == 0 || len(payload) > MaxPacketSize {
+			return
+		}
+		fragments, err := Fragment(1, payload, size)
+		if err != nil {
+			return
+		}
+		if packet := reassemble(t, NewReassembler(), fragments); !bytes.Equal(packet, payload) {
+			t.Fatal("reassembled packet differs")
+		}
+	})
+}
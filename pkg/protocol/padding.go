@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// Padding modes for data packets
+const (
+	PaddingNone     = 0 // Sizes leak the inner packet length
+	PaddingMultiple = 1 // Pad to a multiple of Size bytes
+	PaddingMTU      = 2 // Pad every packet to Size bytes
+	PaddingRandom   = 3 // Add Min to Max random bytes
+
+	// PaddingPolicySize is mode(1) + size(2) + min(2) + max(2)
+	PaddingPolicySize = 7
+
+	// PaddingTrailerSize is the padding length at the end of a padded payload
+	PaddingTrailerSize = 2
+
+	// MaxPadding bounds the padding added to one packet, so padded packets
+	// still fit the pooled buffers
+	MaxPadding = 1500
+)
+
+// PaddingPolicy decides how much padding a data packet gets to hide the
+// length of the packet inside it. When a session pads, every data payload
+// is the inner packet, the padding and a PaddingTrailerSize trailer with
+// the padding length, all encrypted together.
+type PaddingPolicy struct {
+	Mode uint8
+	Size uint16 // Block size for PaddingMultiple, target for PaddingMTU
+	Min  uint16 // Smallest padding for PaddingRandom
+	Max  uint16 // Largest padding for PaddingRandom
+}
+
+// String returns a short description of the policy
+func (p PaddingPolicy) String() string {
+	switch p.Mode {
+	case PaddingNone:
+		return "none"
+	case PaddingMultiple:
+		return fmt.Sprintf("multiple of %d", p.Size)
+	case PaddingMTU:
+		return fmt.Sprintf("mtu %d", p.Size)
+	case PaddingRandom:
+		return fmt.Sprintf("random %d-%d", p.Min, p.Max)
+	default:
+		return fmt.Sprintf("unknown(%d)", p.Mode)
+	}
+}
+
+// Validate checks that the policy is well formed
+func (p PaddingPolicy) Validate() error {
+	switch p.Mode {
+	case PaddingNone:
+	case PaddingMultiple:
+		if p.Size == 0 || p.Size > MaxPadding {
+			return fmt.Errorf("padding block size must be 1-%d", MaxPadding)
+		}
+	case PaddingMTU:
+		// Larger targets could not be reached by small packets, whose
+		// padding is capped at MaxPadding
+		if p.Size == 0 || p.Size > MaxPadding {
+			return fmt.Errorf("padding MTU must be 1-%d", MaxPadding)
+		}
+	case PaddingRandom:
+		if p.Min > p.Max || p.Max > MaxPadding {
+			return fmt.Errorf("random padding range must be within 0-%d", MaxPadding)
+		}
+	default:
+		return fmt.Errorf("unknown padding mode %d", p.Mode)
+	}
+	return nil
+}
+
+// PadLength returns the number of padding bytes for a payload of n bytes
+func (p PaddingPolicy) PadLength(n int) int {
+	var pad int
+	switch p.Mode {
+	case PaddingMultiple:
+		size := int(p.Size)
+		pad = (size - (n+PaddingTrailerSize)%size) % size
+	case PaddingMTU:
+		pad = int(p.Size) - n - PaddingTrailerSize
+	case PaddingRandom:
+		pad = int(p.Min) + rand.IntN(int(p.Max-p.Min)+1)
+	}
+	return max(0, min(pad, MaxPadding))
+}
+
+// AppendPadding pads payload according to the policy and appends the
+// trailer. Padding goes into payload's spare capacity when there is room,
+// so packets read into a pooled buffer are padded in place.
+func (p PaddingPolicy) AppendPadding(payload []byte) []byte {
+	pad := p.PadLength(len(payload))
+	payload = append(payload, make([]byte, pad)...)
+	return binary.BigEndian.AppendUint16(payload, uint16(pad))
+}
+
+// StripPadding removes the padding and trailer from a padded payload
+func StripPadding(payload []byte) ([]byte, error) {
+	if len(payload) < PaddingTrailerSize {
+		return nil, errors.New("padded payload too short")
+	}
+	end := len(payload) - PaddingTrailerSize
+	pad := int(binary.BigEndian.Uint16(payload[end:]))
+	if pad > end {
+		return nil, errors.New("invalid padding length")
+	}
+	return payload[:end-pad], nil
+}
+
+// MarshalPaddingPolicy serializes a padding policy
+func MarshalPaddingPolicy(buf []byte, p PaddingPolicy) {
+	buf[0] = p.Mode
+	binary.BigEndian.PutUint16(buf[1:3], p.Size)
+	binary.BigEndian.PutUint16(buf[3:5], p.Min)
+	binary.BigEndian.PutUint16(buf[5:7], p.Max)
+}
+
+// UnmarshalPaddingPolicy deserializes a padding policy
+func UnmarshalPaddingPolicy(buf []byte) PaddingPolicy {
+	return PaddingPolicy{
+		Mode: buf[0],
+		Size: binary.BigEndian.Uint16(buf[1:3]),
+		Min:  binary.BigEndian.Uint16(buf[3:5]),
+		Max:  binary.BigEndian.Uint16(buf[5:7]),
+	}
+}
+
+// ParsePaddingPolicy parses a policy given as "none", "multiple:<n>",
+// "mtu:<n>" or "random:<min>-<max>"
+func ParsePaddingPolicy(s string) (PaddingPolicy, error) {
+	var p PaddingPolicy
+	mode, arg, _ := strings.Cut(s, ":")
+	var err error
+	switch mode {
+	case "", "none":
+	case "multiple":
+		p.Mode = PaddingMultiple
+		p.Size, err = parseUint16(arg)
+	case "mtu":
+		p.Mode = PaddingMTU
+		p.Size, err = parseUint16(arg)
+	case "random":
+		p.Mode = PaddingRandom
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return PaddingPolicy{}, fmt.Errorf("invalid padding policy %q", s)
+		}
+		if p.Min, err = parseUint16(lo); err == nil {
+			p.Max, err = parseUint16(hi)
+		}
+	default:
+		return PaddingPolicy{}, fmt.Errorf("invalid padding policy %q", s)
+	}
+	if err != nil {
+		return PaddingPolicy{}, fmt.Errorf("invalid padding policy %q: %w", s, err)
+	}
+	if err := p.Validate(); err != nil {
+		return PaddingPolicy{}, err
+	}
+	return p, nil
+}
+
+// parseUint16 parses a decimal uint16
+func parseUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 10, 16)
+	return uint16(v), err
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Ping constants
+const (
+	// PingMessageSize is sequence(4) + timestamp(8)
+	PingMessageSize = 12
+
+	// PongTimeout is how long a ping may go unanswered before it counts as lost
+	PongTimeout = 10 * time.Second
+
+	// LossWindow is the number of recent pings loss is estimated over
+	LossWindow = 32
+)
+
+// PingMessage is carried by encrypted PacketTypePing packets and echoed
+// unchanged in the PacketTypePong answer
+type PingMessage struct {
+	Sequence  uint32
+	Timestamp int64 // Sender's clock in Unix nanoseconds
+}
+
+// MarshalPingMessage serializes a ping or pong
+func MarshalPingMessage(m *PingMessage) []byte {
+	buf := make([]byte, PingMessageSize)
+	binary.BigEndian.PutUint32(buf[0:4], m.Sequence)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(m.Timestamp))
+	return buf
+}
+
+// UnmarshalPingMessage deserializes a ping or pong
+func UnmarshalPingMessage(data []byte) (*PingMessage, error) {
+	if len(data) < PingMessageSize {
+		return nil, errors.New("ping message too short")
+	}
+
+	m := &PingMessage{}
+	m.Sequence = binary.BigEndian.Uint32(data[0:4])
+	m.Timestamp = int64(binary.BigEndian.Uint64(data[4:12]))
+
+	return m, nil
+}
+
+// LinkStats summarizes the health of a tunnel
+type LinkStats struct {
+	RTT           time.Duration // Smoothed round trip time
+	LastRTT       time.Duration // Most recent round trip time
+	Jitter        time.Duration // Smoothed variation between round trips
+	Loss          float64       // Fraction of recent pings that went unanswered
+	PingsSent     uint64
+	PongsReceived uint64
+}
+
+// LinkMonitor sends pings and turns the pongs into LinkStats. RTT and
+// jitter are smoothed like TCP's SRTT and RTTVAR; loss covers the last
+// LossWindow pings that are older than PongTimeout. It is safe for
+// concurrent use.
+type LinkMonitor struct {
+	mu      sync.Mutex
+	nextSeq uint32
+	window  [LossWindow]pingRecord
+	stats   LinkStats
+}
+
+// pingRecord remembers a ping until it is answered or pushed out of the window
+type pingRecord struct {
+	seq      uint32
+	sent     time.Time
+	answered bool
+}
+
+// NewLinkMonitor creates a monitor without samples
+func NewLinkMonitor() *LinkMonitor {
+	return &LinkMonitor{}
+}
+
+// NextPing returns the message of a new ping sent now
+func (m *LinkMonitor) NextPing() *PingMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.nextSeq++
+	m.window[m.nextSeq%LossWindow] = pingRecord{seq: m.nextSeq, sent: now}
+	m.stats.PingsSent++
+	return &PingMessage{Sequence: m.nextSeq, Timestamp: now.UnixNano()}
+}
+
+// HandlePong records the answer to one of our pings and returns the round
+// trip time. Pongs for unknown, repeated or forgotten pings are ignored.
+func (m *LinkMonitor) HandlePong(pong *PingMessage) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	record := &m.window[pong.Sequence%LossWindow]
+	if record.seq != pong.Sequence || record.sent.IsZero() || record.answered ||
+		pong.Timestamp != record.sent.UnixNano() {
+		return 0, false
+	}
+	record.answered = true
+
+	rtt := time.Since(record.sent)
+	s := &m.stats
+	if s.PongsReceived == 0 {
+		s.RTT = rtt
+		s.Jitter = rtt / 2
+	} else {
+		s.Jitter += (absDuration(s.RTT-rtt) - s.Jitter) / 4
+		s.RTT += (rtt - s.RTT) / 8
+	}
+	s.LastRTT = rtt
+	s.PongsReceived++
+	return rtt, true
+}
+
+// Stats returns the current link statistics
+func (m *LinkMonitor) Stats() LinkStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := m.stats
+	var due, lost int
+	for _, record := range m.window {
+		if record.sent.IsZero() || time.Since(record.sent) < PongTimeout {
+			continue
+		}
+		due++
+		if !record.answered {
+			lost++
+		}
+	}
+	if due > 0 {
+		stats.Loss = float64(lost) / float64(due)
+	}
+	return stats
+}
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
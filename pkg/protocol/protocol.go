@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"time"
@@ -12,8 +14,19 @@ const (
 	MagicByte1 = 0x48 // 'H'
 	MagicByte2 = 0x56 // 'V'
 	
-	// Protocol version
-	ProtocolVersion = 1
+	// Protocol versions this build speaks. ProtocolVersion is the newest
+	// and is what a client tries first. Version 2 extends the sealed
+	// handshake payloads and resumption tickets; see InitPayloadLen.
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+	
+	// Header version of version negotiation packets, readable by any build
+	VersionNegotiationVersion = 0
+	
+	// LegacyHandshakeVersion is the newest version whose handshake packets
+	// go out in the clear. Later versions mask their headers with a key
+	// derived from the server's public key; see crypto.NewHandshakeProtector.
+	LegacyHandshakeVersion = 1
 	
 	// Packet types
 	PacketTypeHandshakeInit     = 0x01
@@ -21,6 +34,14 @@ const (
 	PacketTypeData              = 0x03
 	PacketTypeKeepAlive         = 0x04
 	PacketTypeDisconnect        = 0x05
+	PacketTypeRekey             = 0x06
+	PacketTypeCookieReply       = 0x07
+	PacketTypeTicket            = 0x08
+	PacketTypeVersionNegotiation = 0x09
+	PacketTypeFragment          = 0x0A
+	PacketTypePing              = 0x0B
+	PacketTypePong              = 0x0C
+	PacketTypeBatch             = 0x0D
 	
 	// Maximum packet size
 	MaxPacketSize = 65535
@@ -33,8 +54,53 @@ const (
 	
 	// Keep-alive interval
 	KeepAliveInterval = 25 * time.Second
+	
+	// Maximum clock difference accepted for a handshake init timestamp
+	HandshakeTimestampWindow = 3 * time.Minute
+	
+	// How long a resumption ticket stays valid; the server sends a fresh
+	// one whenever half of that has passed
+	TicketLifetime = 10 * time.Minute
+	
+	// Default rekey thresholds
+	RekeyAfterTime  = 2 * time.Minute
+	RekeyAfterBytes = 1 << 30
+	
+	// Rekey message kinds
+	RekeyInit     = 0x01
+	RekeyResponse = 0x02
+	RekeyConfirm  = 0x03 // Sent under the new keys to let the responder switch
+	
+	// RekeyMessageSize is kind(1) + epoch(1) + ephemeral(32)
+	RekeyMessageSize = 34
+	
+	// Handshake flags
+	HandshakeFlagHybrid = 0x01 // Message carries an ML-KEM-768 key or ciphertext
+	HandshakeFlagResume = 0x02 // Init carries a resumption ticket
+	HandshakeFlagExtensions = 0x04 // Response seals an extension block after the session params
+	
+	// Capability flags, negotiated per session as the intersection of what
+	// the client offers and the server enables
+	CapabilityResumption = 1 << 0 // Server issues resumption tickets
+	CapabilityIPv6       = 1 << 1 // Client gets an IPv6 address next to the IPv4 one
+	CapabilityExtensions = 1 << 2 // Server pushes client configuration as TLV extensions
+	CapabilityPadding    = 1 << 3 // Data payloads carry padding under the session's PaddingPolicy
+	CapabilityFragmentation = 1 << 4 // Data payloads too large for the transport are sent as fragments
+	CapabilityPing       = 1 << 5 // Timestamped pings replace keepalives and measure the link
+	CapabilityBatching   = 1 << 6 // Several data payloads may share one PacketTypeBatch packet
+	CapabilityCompression = 1 << 7 // Data payloads carry a compression header and may be DEFLATE compressed
+	CapabilityHeaderProtection = 1 << 8 // Header and crypto prefix of packets after the handshake are masked
+	
+	// SupportedCapabilities has every capability this build implements
+	SupportedCapabilities = CapabilityResumption | CapabilityIPv6 | CapabilityExtensions | CapabilityPadding |
+		CapabilityFragmentation | CapabilityPing | CapabilityBatching | CapabilityCompression |
+		CapabilityHeaderProtection
 )
 
+// ErrUnsupportedVersion is returned for packets of a protocol version
+// outside MinProtocolVersion..ProtocolVersion
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
 // PacketHeader represents the header of a HydraVPN packet
 type PacketHeader struct {
 	Magic     [2]byte
@@ -48,64 +114,372 @@ type PacketHeader struct {
 type Packet struct {
 	Header  PacketHeader
 	Payload []byte
+	
+	raw []byte // Header bytes of the buffer the packet was parsed from
 }
 
+// Handshake message sizes
+const (
+	// EncryptedStaticSize is the sealed client static key: key(32) + tag(16)
+	EncryptedStaticSize = 32 + 16
+	
+	// TimestampSize is the size of a TAI64N timestamp
+	TimestampSize = 12
+	
+	// MaxCipherSuites is the number of cipher suites a client can offer
+	MaxCipherSuites = 4
+	
+	// InitPayloadSizeV1 is the plaintext size of a version 1 InitPayload
+	InitPayloadSizeV1 = TimestampSize + MaxCipherSuites + 1 + 1 + 4
+	
+	// InitPayloadSize is the plaintext size of InitPayload. Version 2
+	// appends the padding policy.
+	InitPayloadSize = InitPayloadSizeV1 + PaddingPolicySize
+	
+	// SessionParamsSizeV1 is the plaintext size of version 1 SessionParams
+	SessionParamsSizeV1 = 8 + 4 + 4 + 1 + 1 + 1 + 4
+	
+	// SessionParamsSize is the plaintext size of SessionParams. Version 2
+	// appends the IPv6 addresses and the padding policy.
+	SessionParamsSize = SessionParamsSizeV1 + 16 + 16 + 1 + PaddingPolicySize
+	
+	// KEMEncapsulationKeySize is the size of an ML-KEM-768 encapsulation key
+	KEMEncapsulationKeySize = 1184
+	
+	// KEMCiphertextSize is the size of an ML-KEM-768 ciphertext
+	KEMCiphertextSize = 1088
+	
+	// CookieReplySize is nonce(24) + encrypted cookie(16+16)
+	CookieReplySize = 24 + 32
+	
+	// TicketStateSizeV1 is the plaintext size of a version 1 TicketState
+	TicketStateSizeV1 = 8 + 4 + 8
+	
+	// TicketStateSize is the plaintext size of TicketState. Version 2
+	// appends the IPv6 address.
+	TicketStateSize = TicketStateSizeV1 + 16
+	
+	// VersionNegotiationSize is min version(1) + max version(1)
+	VersionNegotiationSize = 2
+	
+	// VersionNegotiationPaddingSize is the random padding after a version
+	// negotiation payload, enough to sample when masking its header
+	VersionNegotiationPaddingSize = 16
+)
+
 // HandshakeInit is the first message from client to server
 type HandshakeInit struct {
-	ClientPublicKey [32]byte
-	Timestamp       int64
-	RandomPadding   [32]byte // Random padding to make packet size variable
+	Version            uint8 // Protocol version of the packet header, which fixes the layout; not marshaled
+	EphemeralPublicKey [32]byte
+	EncryptedStatic    [EncryptedStaticSize]byte    // Client static key, sealed to the server static key
+	EncryptedPayload   []byte   // Sealed InitPayload, also proves possession of the client static key
+	Flags              uint8
+	KEMPublicKey       []byte   // ML-KEM-768 encapsulation key, present with HandshakeFlagHybrid
+	Ticket             []byte   // Resumption ticket, present with HandshakeFlagResume
+	RandomPadding      [32]byte // Random padding to make packet size variable
+	MAC1               [16]byte // Keyed by the server public key, checked before any DH
+	MAC2               [16]byte // Keyed by a cookie, required while the server is under load
 }
 
 // HandshakeResponse is the server's response to handshake init
 type HandshakeResponse struct {
-	ServerPublicKey [32]byte
-	SessionID       uint64
-	AssignedIP      [4]byte  // Client's assigned IP in the VPN
-	ServerIP        [4]byte  // Server's IP in the VPN
-	Subnet          uint8    // Subnet mask bits (e.g., 24 for /24)
-	RandomPadding   [32]byte
+	Version            uint8 // Protocol version of the packet header, which fixes the layout; not marshaled
+	EphemeralPublicKey [32]byte
+	Flags              uint8
+	KEMCiphertext      []byte   // ML-KEM-768 ciphertext, present with HandshakeFlagHybrid
+	ExtensionsSize     uint16   // Plaintext size of the extension block, present with HandshakeFlagExtensions
+	EncryptedParams    []byte   // Sealed SessionParams, followed by the extension block if any
+	RandomPadding      [32]byte
+}
+
+// Timestamp is a TAI64N timestamp: 8 bytes of TAI seconds and 4 bytes of
+// nanoseconds, both big-endian, so later timestamps compare greater
+type Timestamp [TimestampSize]byte
+
+// tai64nBase is the TAI64 label of the Unix epoch, including the 10 second TAI offset
+const tai64nBase = 0x400000000000000a
+
+// tai64nWhitener rounds nanoseconds down so timestamps do not leak precise clock readings
+const tai64nWhitener = 0x1000000
+
+// NewTimestamp encodes t as a TAI64N timestamp
+func NewTimestamp(t time.Time) Timestamp {
+	var ts Timestamp
+	nanos := t.Nanosecond()
+	binary.BigEndian.PutUint64(ts[0:8], uint64(tai64nBase+t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:12], uint32(nanos-nanos%tai64nWhitener))
+	return ts
+}
+
+// Time decodes the timestamp
+func (ts Timestamp) Time() time.Time {
+	secs := int64(binary.BigEndian.Uint64(ts[0:8]) - tai64nBase)
+	nanos := int64(binary.BigEndian.Uint32(ts[8:12]))
+	return time.Unix(secs, nanos)
+}
+
+// After reports whether ts is strictly later than other
+func (ts Timestamp) After(other Timestamp) bool {
+	return bytes.Compare(ts[:], other[:]) > 0
+}
+
+// CookieReply is sent instead of a handshake response when the server is
+// under load. The client must echo the cookie in MAC2 of its next init.
+type CookieReply struct {
+	Nonce           [24]byte
+	EncryptedCookie [32]byte
+}
+
+// VersionNegotiation is the server's answer to a handshake init of a
+// version it does not speak. It is not authenticated, so clients only use
+// it to pick a version to retry with.
+type VersionNegotiation struct {
+	MinVersion uint8
+	MaxVersion uint8
+}
+
+// InitPayload carries the client's settings sealed inside the handshake init
+type InitPayload struct {
+	Timestamp    Timestamp              // TAI64N time the init was created
+	CipherSuites [MaxCipherSuites]uint8 // Offered suites in preference order, zero terminated
+	MinVersion   uint8                  // Oldest protocol version the client speaks
+	MaxVersion   uint8                  // Newest protocol version the client speaks
+	Capabilities uint32                 // Capability flags the client offers
+	Padding      PaddingPolicy          // Padding the client asks for; version 2
+}
+
+// SessionParams carries the tunnel settings sealed inside the handshake response
+type SessionParams struct {
+	SessionID    uint64
+	AssignedIP   [4]byte  // Client's assigned IP in the VPN
+	ServerIP     [4]byte  // Server's IP in the VPN
+	Subnet       uint8    // Subnet mask bits (e.g., 24 for /24)
+	CipherSuite  uint8    // Suite picked by the server from the client's offer
+	Version      uint8    // Protocol version of the session
+	Capabilities uint32   // Capability flags enabled for the session
+	AssignedIP6  [16]byte // Client's IPv6 address, zero unless CapabilityIPv6 is enabled; version 2
+	ServerIP6    [16]byte // Server's IPv6 address in the VPN; version 2
+	Prefix6      uint8    // IPv6 prefix length (e.g., 64); version 2
+	Padding      PaddingPolicy // Padding both sides apply, with CapabilityPadding; version 2
+}
+
+// TicketState is what the server remembers about a session inside a
+// resumption ticket. Only the server can read it.
+type TicketState struct {
+	SessionID   uint64
+	AssignedIP  [4]byte
+	Expiry      int64    // Unix time after which the ticket is refused
+	AssignedIP6 [16]byte // Zero if the session had no IPv6 address; version 2
+}
+
+// RekeyMessage is exchanged inside an encrypted PacketTypeRekey packet
+type RekeyMessage struct {
+	Kind               uint8
+	Epoch              uint8 // Key epoch being negotiated
+	EphemeralPublicKey [32]byte
 }
 
 // NewPacket creates a new packet with the given type and payload
 func NewPacket(packetType uint8, sessionID uint64, payload []byte) *Packet {
 	return &Packet{
-		Header: PacketHeader{
-			Magic:     [2]byte{MagicByte1, MagicByte2},
-			Version:   ProtocolVersion,
-			Type:      packetType,
-			SessionID: sessionID,
-			Length:    uint16(len(payload)),
-		},
+		Header:  NewHeader(packetType, sessionID, len(payload)),
 		Payload: payload,
 	}
 }
 
+// SupportsVersion reports whether this build speaks protocol version v
+func SupportsVersion(v uint8) bool {
+	return v >= MinProtocolVersion && v <= ProtocolVersion
+}
+
+// NegotiateVersion picks the newest version in both ranges. It returns
+// false if the ranges do not overlap.
+func NegotiateVersion(minA, maxA, minB, maxB uint8) (uint8, bool) {
+	version := min(maxA, maxB)
+	return version, version >= max(minA, minB)
+}
+
+// VersionCapabilities returns the capabilities a session of the given
+// protocol version can use. Version 1 session params have no room for
+// IPv6 addresses.
+func VersionCapabilities(version uint8) uint32 {
+	if version < 2 {
+		return SupportedCapabilities &^ CapabilityIPv6
+	}
+	return SupportedCapabilities
+}
+
+// InitPayloadLen returns the plaintext size of an InitPayload of the given
+// protocol version. Sealed handshake payloads and resumption tickets have
+// a fixed layout per version, so fields added to them need a new version.
+func InitPayloadLen(version uint8) int {
+	if version < 2 {
+		return InitPayloadSizeV1
+	}
+	return InitPayloadSize
+}
+
+// SessionParamsLen returns the plaintext size of SessionParams of the
+// given protocol version
+func SessionParamsLen(version uint8) int {
+	if version < 2 {
+		return SessionParamsSizeV1
+	}
+	return SessionParamsSize
+}
+
+// TicketStateLen returns the plaintext size of a TicketState of the given
+// protocol version
+func TicketStateLen(version uint8) int {
+	if version < 2 {
+		return TicketStateSizeV1
+	}
+	return TicketStateSize
+}
+
+// ResumptionTicketLen returns the size of a sealed TicketState of the given
+// protocol version: nonce(24) + state + tag(16)
+func ResumptionTicketLen(version uint8) int {
+	return 24 + TicketStateLen(version) + 16
+}
+
+// NewHeader creates a header of the current protocol version for a payload
+// of the given length
+func NewHeader(packetType uint8, sessionID uint64, length int) PacketHeader {
+	return PacketHeader{
+		Magic:     [2]byte{MagicByte1, MagicByte2},
+		Version:   ProtocolVersion,
+		Type:      packetType,
+		SessionID: sessionID,
+		Length:    uint16(length),
+	}
+}
+
+// MarshalTo writes the header into the first HeaderSize bytes of buf
+func (h PacketHeader) MarshalTo(buf []byte) {
+	buf[0] = h.Magic[0]
+	buf[1] = h.Magic[1]
+	buf[2] = h.Version
+	buf[3] = h.Type
+	binary.BigEndian.PutUint64(buf[4:12], h.SessionID)
+	binary.BigEndian.PutUint16(buf[12:14], h.Length)
+}
+
+// Marshal serializes the header, which is also the associated data
+// authenticated with every encrypted payload
+func (h PacketHeader) Marshal() []byte {
+	buf := make([]byte, HeaderSize)
+	h.MarshalTo(buf)
+	return buf
+}
+
 // Marshal serializes a packet to bytes
 func (p *Packet) Marshal() []byte {
-	buf := make([]byte, HeaderSize+len(p.Payload))
+	return p.MarshalAppend(make([]byte, 0, HeaderSize+len(p.Payload)))
+}
+
+// MarshalAppend appends the serialized packet to dst
+func (p *Packet) MarshalAppend(dst []byte) []byte {
+	start := len(dst)
+	dst = append(dst, zeroHeader[:]...)
 	
 	// Write header
-	buf[0] = p.Header.Magic[0]
-	buf[1] = p.Header.Magic[1]
-	buf[2] = p.Header.Version
-	buf[3] = p.Header.Type
-	binary.BigEndian.PutUint64(buf[4:12], p.Header.SessionID)
-	binary.BigEndian.PutUint16(buf[12:14], p.Header.Length)
+	p.Header.MarshalTo(dst[start:])
 	
 	// Write payload
-	copy(buf[HeaderSize:], p.Payload)
+	return append(dst, p.Payload...)
+}
+
+// zeroHeader reserves room for a header without allocating
+var zeroHeader [HeaderSize]byte
+
+// PayloadCipher encrypts packet payloads with associated data.
+// It is implemented by crypto.Keyring.
+type PayloadCipher interface {
+	Overhead() int
+	SealAppend(dst, plaintext, additionalData []byte) ([]byte, error)
+	OpenAppend(dst, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// SealPacket encrypts plaintext into a packet of the session's protocol
+// version whose header is authenticated along with the payload, so none of
+// its fields can be rewritten in transit
+func SealPacket(c PayloadCipher, version, packetType uint8, sessionID uint64, plaintext []byte) (*Packet, error) {
+	buf, err := AppendSealedPacket(nil, c, version, packetType, sessionID, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	p := &Packet{}
+	if err := UnmarshalPacketInto(p, buf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AppendSealedPacket is like SealPacket but appends the serialized packet to
+// dst. For in-place encryption, plaintext may sit in dst's spare capacity at
+// offset len(dst)+HeaderSize+prefix, where prefix is what the cipher writes
+// before the sealed data (crypto.PrefixSize for a Keyring).
+func AppendSealedPacket(dst []byte, c PayloadCipher, version, packetType uint8, sessionID uint64, plaintext []byte) ([]byte, error) {
+	length := c.Overhead() + len(plaintext)
+	if length > MaxPacketSize {
+		return nil, errors.New("payload too large")
+	}
 	
-	return buf
+	start := len(dst)
+	header := NewHeader(packetType, sessionID, length)
+	header.Version = version
+	dst = append(dst, zeroHeader[:]...)
+	header.MarshalTo(dst[start:])
+	
+	out, err := c.SealAppend(dst, plaintext, dst[start:start+HeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	if len(out)-start-HeaderSize != length {
+		return nil, errors.New("sealed payload length mismatch")
+	}
+	return out, nil
+}
+
+// OpenPacket decrypts a sealed packet, verifying its header
+func OpenPacket(c PayloadCipher, p *Packet) ([]byte, error) {
+	return OpenPacketAppend(nil, c, p)
+}
+
+// OpenPacketAppend is like OpenPacket but appends the plaintext to dst
+func OpenPacketAppend(dst []byte, c PayloadCipher, p *Packet) ([]byte, error) {
+	// The associated data is always rebuilt from p.Header, so the fields
+	// the caller acts on are the ones that get verified. Parsed packets
+	// reuse their own header bytes to avoid an allocation.
+	header := p.raw
+	if len(header) != HeaderSize {
+		header = make([]byte, HeaderSize)
+	}
+	p.Header.MarshalTo(header)
+	return c.OpenAppend(dst, p.Payload, header)
 }
 
 // UnmarshalPacket deserializes bytes to a packet
 func UnmarshalPacket(data []byte) (*Packet, error) {
-	if len(data) < HeaderSize {
-		return nil, errors.New("packet too short")
+	p := &Packet{}
+	if err := UnmarshalPacketInto(p, data); err != nil {
+		return nil, err
 	}
 	
-	p := &Packet{}
+	// Copy payload so data can be reused
+	p.Payload = append([]byte(nil), p.Payload...)
+	p.raw = nil
+	
+	return p, nil
+}
+
+// UnmarshalPacketInto parses data into a preallocated packet without
+// copying. The payload aliases data and is only valid until data is reused.
+func UnmarshalPacketInto(p *Packet, data []byte) error {
+	if len(data) < HeaderSize {
+		return errors.New("packet too short")
+	}
 	
 	// Read header
 	p.Header.Magic[0] = data[0]
@@ -113,82 +487,370 @@ func UnmarshalPacket(data []byte) (*Packet, error) {
 	
 	// Validate magic bytes
 	if p.Header.Magic[0] != MagicByte1 || p.Header.Magic[1] != MagicByte2 {
-		return nil, errors.New("invalid magic bytes")
+		return errors.New("invalid magic bytes")
 	}
 	
 	p.Header.Version = data[2]
-	if p.Header.Version != ProtocolVersion {
-		return nil, errors.New("unsupported protocol version")
-	}
-	
 	p.Header.Type = data[3]
 	p.Header.SessionID = binary.BigEndian.Uint64(data[4:12])
 	p.Header.Length = binary.BigEndian.Uint16(data[12:14])
 	
+	// Version negotiation has a version of its own so old builds can read it
+	if p.Header.Type == PacketTypeVersionNegotiation {
+		if p.Header.Version != VersionNegotiationVersion {
+			return ErrUnsupportedVersion
+		}
+	} else if !SupportsVersion(p.Header.Version) {
+		return ErrUnsupportedVersion
+	}
+	
 	// Validate length
 	if int(p.Header.Length) != len(data)-HeaderSize {
-		return nil, errors.New("payload length mismatch")
+		return errors.New("payload length mismatch")
 	}
 	
-	// Read payload
-	p.Payload = make([]byte, p.Header.Length)
-	copy(p.Payload, data[HeaderSize:])
+	p.Payload = data[HeaderSize:]
+	p.raw = data[:HeaderSize]
 	
-	return p, nil
+	return nil
+}
+
+// Size returns the marshaled size of the handshake init
+func (h *HandshakeInit) Size() int {
+	// ephemeral + static + payload + tag + flags + padding + macs
+	size := 32 + EncryptedStaticSize + InitPayloadLen(h.Version) + 16 + 1 + 32 + 16 + 16
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		size += KEMEncapsulationKeySize
+	}
+	if h.Flags&HandshakeFlagResume != 0 {
+		size += ResumptionTicketLen(h.Version)
+	}
+	return size
+}
+
+// flagsOffset returns where the flags follow the fixed size fields
+func (h *HandshakeInit) flagsOffset() int {
+	return 32 + EncryptedStaticSize + InitPayloadLen(h.Version) + 16
 }
 
 // MarshalHandshakeInit serializes handshake init message
 func MarshalHandshakeInit(h *HandshakeInit) []byte {
-	buf := make([]byte, 32+8+32) // public key + timestamp + padding
-	copy(buf[0:32], h.ClientPublicKey[:])
-	binary.BigEndian.PutUint64(buf[32:40], uint64(h.Timestamp))
-	copy(buf[40:72], h.RandomPadding[:])
+	// ephemeral + static + payload + flags + [kem key] + [ticket] + padding + macs
+	buf := make([]byte, h.Size())
+	copy(buf[0:32], h.EphemeralPublicKey[:])
+	copy(buf[32:80], h.EncryptedStatic[:])
+	copy(buf[80:h.flagsOffset()], h.EncryptedPayload)
+	buf[h.flagsOffset()] = h.Flags
+	offset := h.flagsOffset() + 1
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		copy(buf[offset:offset+KEMEncapsulationKeySize], h.KEMPublicKey)
+		offset += KEMEncapsulationKeySize
+	}
+	if h.Flags&HandshakeFlagResume != 0 {
+		ticketLen := ResumptionTicketLen(h.Version)
+		copy(buf[offset:offset+ticketLen], h.Ticket)
+		offset += ticketLen
+	}
+	copy(buf[offset:offset+32], h.RandomPadding[:])
+	copy(buf[offset+32:offset+48], h.MAC1[:])
+	copy(buf[offset+48:offset+64], h.MAC2[:])
 	return buf
 }
 
-// UnmarshalHandshakeInit deserializes handshake init message
-func UnmarshalHandshakeInit(data []byte) (*HandshakeInit, error) {
-	if len(data) < 72 {
+// UnmarshalHandshakeInit deserializes a handshake init message of the
+// given protocol version
+func UnmarshalHandshakeInit(data []byte, version uint8) (*HandshakeInit, error) {
+	h := &HandshakeInit{Version: version}
+	if len(data) < h.Size() {
 		return nil, errors.New("handshake init too short")
 	}
 	
-	h := &HandshakeInit{}
-	copy(h.ClientPublicKey[:], data[0:32])
-	h.Timestamp = int64(binary.BigEndian.Uint64(data[32:40]))
-	copy(h.RandomPadding[:], data[40:72])
+	copy(h.EphemeralPublicKey[:], data[0:32])
+	copy(h.EncryptedStatic[:], data[32:80])
+	h.EncryptedPayload = make([]byte, h.flagsOffset()-80)
+	copy(h.EncryptedPayload, data[80:h.flagsOffset()])
+	h.Flags = data[h.flagsOffset()]
+	offset := h.flagsOffset() + 1
+	if len(data) < h.Size() {
+		return nil, errors.New("handshake init too short for its flags")
+	}
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		h.KEMPublicKey = make([]byte, KEMEncapsulationKeySize)
+		copy(h.KEMPublicKey, data[offset:offset+KEMEncapsulationKeySize])
+		offset += KEMEncapsulationKeySize
+	}
+	if h.Flags&HandshakeFlagResume != 0 {
+		ticketLen := ResumptionTicketLen(version)
+		h.Ticket = make([]byte, ticketLen)
+		copy(h.Ticket, data[offset:offset+ticketLen])
+		offset += ticketLen
+	}
+	copy(h.RandomPadding[:], data[offset:offset+32])
+	copy(h.MAC1[:], data[offset+32:offset+48])
+	copy(h.MAC2[:], data[offset+48:offset+64])
 	
 	return h, nil
 }
 
+// Size returns the marshaled size of the handshake response
+func (h *HandshakeResponse) Size() int {
+	// ephemeral + flags + sealed params + padding
+	size := 32 + 1 + SessionParamsLen(h.Version) + 16 + 32
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		size += KEMCiphertextSize
+	}
+	if h.Flags&HandshakeFlagExtensions != 0 {
+		size += 2 + int(h.ExtensionsSize)
+	}
+	return size
+}
+
+// EncryptedParamsLen returns the size of the sealed params and extensions
+func (h *HandshakeResponse) EncryptedParamsLen() int {
+	size := SessionParamsLen(h.Version) + 16
+	if h.Flags&HandshakeFlagExtensions != 0 {
+		size += int(h.ExtensionsSize)
+	}
+	return size
+}
+
 // MarshalHandshakeResponse serializes handshake response message
 func MarshalHandshakeResponse(h *HandshakeResponse) []byte {
-	buf := make([]byte, 32+8+4+4+1+32) // pubkey + session + assigned_ip + server_ip + subnet + padding
-	copy(buf[0:32], h.ServerPublicKey[:])
-	binary.BigEndian.PutUint64(buf[32:40], h.SessionID)
-	copy(buf[40:44], h.AssignedIP[:])
-	copy(buf[44:48], h.ServerIP[:])
-	buf[48] = h.Subnet
-	copy(buf[49:81], h.RandomPadding[:])
+	// ephemeral + flags + [kem ciphertext] + [extensions size] + sealed params + padding
+	buf := make([]byte, h.Size())
+	copy(buf[0:32], h.EphemeralPublicKey[:])
+	buf[32] = h.Flags
+	offset := 33
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		copy(buf[offset:offset+KEMCiphertextSize], h.KEMCiphertext)
+		offset += KEMCiphertextSize
+	}
+	if h.Flags&HandshakeFlagExtensions != 0 {
+		binary.BigEndian.PutUint16(buf[offset:offset+2], h.ExtensionsSize)
+		offset += 2
+	}
+	paramsLen := h.EncryptedParamsLen()
+	copy(buf[offset:offset+paramsLen], h.EncryptedParams)
+	copy(buf[offset+paramsLen:], h.RandomPadding[:])
 	return buf
 }
 
-// UnmarshalHandshakeResponse deserializes handshake response message
-func UnmarshalHandshakeResponse(data []byte) (*HandshakeResponse, error) {
-	if len(data) < 81 {
+// UnmarshalHandshakeResponse deserializes a handshake response message of
+// the given protocol version
+func UnmarshalHandshakeResponse(data []byte, version uint8) (*HandshakeResponse, error) {
+	h := &HandshakeResponse{Version: version}
+	if len(data) < h.Size() {
 		return nil, errors.New("handshake response too short")
 	}
 	
-	h := &HandshakeResponse{}
-	copy(h.ServerPublicKey[:], data[0:32])
-	h.SessionID = binary.BigEndian.Uint64(data[32:40])
-	copy(h.AssignedIP[:], data[40:44])
-	copy(h.ServerIP[:], data[44:48])
-	h.Subnet = data[48]
-	copy(h.RandomPadding[:], data[49:81])
+	copy(h.EphemeralPublicKey[:], data[0:32])
+	h.Flags = data[32]
+	offset := 33
+	if h.Flags&HandshakeFlagHybrid != 0 {
+		if len(data) < h.Size() {
+			return nil, errors.New("hybrid handshake response too short")
+		}
+		h.KEMCiphertext = make([]byte, KEMCiphertextSize)
+		copy(h.KEMCiphertext, data[offset:offset+KEMCiphertextSize])
+		offset += KEMCiphertextSize
+	}
+	if h.Flags&HandshakeFlagExtensions != 0 {
+		if len(data) < offset+2 {
+			return nil, errors.New("handshake response too short for extensions")
+		}
+		h.ExtensionsSize = binary.BigEndian.Uint16(data[offset : offset+2])
+		if len(data) < h.Size() {
+			return nil, errors.New("handshake response too short for extensions")
+		}
+		offset += 2
+	}
+	paramsLen := h.EncryptedParamsLen()
+	h.EncryptedParams = make([]byte, paramsLen)
+	copy(h.EncryptedParams, data[offset:offset+paramsLen])
+	copy(h.RandomPadding[:], data[offset+paramsLen:offset+paramsLen+32])
 	
 	return h, nil
 }
 
+// MarshalCookieReply serializes a cookie reply
+func MarshalCookieReply(c *CookieReply) []byte {
+	buf := make([]byte, CookieReplySize)
+	copy(buf[0:24], c.Nonce[:])
+	copy(buf[24:56], c.EncryptedCookie[:])
+	return buf
+}
+
+// UnmarshalCookieReply deserializes a cookie reply
+func UnmarshalCookieReply(data []byte) (*CookieReply, error) {
+	if len(data) < CookieReplySize {
+		return nil, errors.New("cookie reply too short")
+	}
+	
+	c := &CookieReply{}
+	copy(c.Nonce[:], data[0:24])
+	copy(c.EncryptedCookie[:], data[24:56])
+	
+	return c, nil
+}
+
+// MarshalInitPayload serializes the handshake init payload in the layout
+// of the given protocol version
+func MarshalInitPayload(p *InitPayload, version uint8) []byte {
+	buf := make([]byte, InitPayloadLen(version)) // timestamp + cipher suites + versions + capabilities + [padding]
+	copy(buf[0:TimestampSize], p.Timestamp[:])
+	offset := TimestampSize
+	copy(buf[offset:offset+MaxCipherSuites], p.CipherSuites[:])
+	offset += MaxCipherSuites
+	buf[offset] = p.MinVersion
+	buf[offset+1] = p.MaxVersion
+	binary.BigEndian.PutUint32(buf[offset+2:offset+6], p.Capabilities)
+	if version >= 2 {
+		MarshalPaddingPolicy(buf[InitPayloadSizeV1:], p.Padding)
+	}
+	return buf
+}
+
+// UnmarshalInitPayload deserializes a handshake init payload of the given
+// protocol version
+func UnmarshalInitPayload(data []byte, version uint8) (*InitPayload, error) {
+	if len(data) < InitPayloadLen(version) {
+		return nil, errors.New("init payload too short")
+	}
+	
+	p := &InitPayload{}
+	copy(p.Timestamp[:], data[0:TimestampSize])
+	offset := TimestampSize
+	copy(p.CipherSuites[:], data[offset:offset+MaxCipherSuites])
+	offset += MaxCipherSuites
+	p.MinVersion = data[offset]
+	p.MaxVersion = data[offset+1]
+	p.Capabilities = binary.BigEndian.Uint32(data[offset+2 : offset+6])
+	if version >= 2 {
+		p.Padding = UnmarshalPaddingPolicy(data[InitPayloadSizeV1:])
+	}
+	
+	return p, nil
+}
+
+// MarshalSessionParams serializes session parameters in the layout of
+// their version
+func MarshalSessionParams(p *SessionParams) []byte {
+	buf := make([]byte, SessionParamsLen(p.Version)) // session + assigned_ip + server_ip + subnet + suite + version + capabilities + [ipv6 + padding]
+	binary.BigEndian.PutUint64(buf[0:8], p.SessionID)
+	copy(buf[8:12], p.AssignedIP[:])
+	copy(buf[12:16], p.ServerIP[:])
+	buf[16] = p.Subnet
+	buf[17] = p.CipherSuite
+	buf[18] = p.Version
+	binary.BigEndian.PutUint32(buf[19:23], p.Capabilities)
+	if p.Version >= 2 {
+		copy(buf[23:39], p.AssignedIP6[:])
+		copy(buf[39:55], p.ServerIP6[:])
+		buf[55] = p.Prefix6
+		MarshalPaddingPolicy(buf[56:], p.Padding)
+	}
+	return buf
+}
+
+// UnmarshalSessionParams deserializes session parameters of the given
+// protocol version
+func UnmarshalSessionParams(data []byte, version uint8) (*SessionParams, error) {
+	if len(data) < SessionParamsLen(version) {
+		return nil, errors.New("session params too short")
+	}
+	
+	p := &SessionParams{}
+	p.SessionID = binary.BigEndian.Uint64(data[0:8])
+	copy(p.AssignedIP[:], data[8:12])
+	copy(p.ServerIP[:], data[12:16])
+	p.Subnet = data[16]
+	p.CipherSuite = data[17]
+	p.Version = data[18]
+	p.Capabilities = binary.BigEndian.Uint32(data[19:23])
+	if version >= 2 {
+		copy(p.AssignedIP6[:], data[23:39])
+		copy(p.ServerIP6[:], data[39:55])
+		p.Prefix6 = data[55]
+		p.Padding = UnmarshalPaddingPolicy(data[56:])
+	}
+	
+	return p, nil
+}
+
+// NewVersionNegotiationPacket creates the answer to a handshake init of an
+// unsupported version, listing the versions this build speaks
+func NewVersionNegotiationPacket() *Packet {
+	payload := make([]byte, VersionNegotiationSize+VersionNegotiationPaddingSize)
+	payload[0], payload[1] = MinProtocolVersion, ProtocolVersion
+	rand.Read(payload[VersionNegotiationSize:])
+	p := NewPacket(PacketTypeVersionNegotiation, 0, payload)
+	p.Header.Version = VersionNegotiationVersion
+	return p
+}
+
+// UnmarshalVersionNegotiation deserializes a version negotiation payload
+func UnmarshalVersionNegotiation(data []byte) (*VersionNegotiation, error) {
+	if len(data) < VersionNegotiationSize {
+		return nil, errors.New("version negotiation too short")
+	}
+	
+	return &VersionNegotiation{MinVersion: data[0], MaxVersion: data[1]}, nil
+}
+
+// MarshalTicketState serializes the contents of a resumption ticket in
+// the layout of the given protocol version
+func MarshalTicketState(t *TicketState, version uint8) []byte {
+	buf := make([]byte, TicketStateLen(version)) // session + assigned_ip + expiry + [assigned_ip6]
+	binary.BigEndian.PutUint64(buf[0:8], t.SessionID)
+	copy(buf[8:12], t.AssignedIP[:])
+	binary.BigEndian.PutUint64(buf[12:20], uint64(t.Expiry))
+	if version >= 2 {
+		copy(buf[20:36], t.AssignedIP6[:])
+	}
+	return buf
+}
+
+// UnmarshalTicketState deserializes the contents of a resumption ticket of
+// the given protocol version
+func UnmarshalTicketState(data []byte, version uint8) (*TicketState, error) {
+	if len(data) < TicketStateLen(version) {
+		return nil, errors.New("ticket state too short")
+	}
+	
+	t := &TicketState{}
+	t.SessionID = binary.BigEndian.Uint64(data[0:8])
+	copy(t.AssignedIP[:], data[8:12])
+	t.Expiry = int64(binary.BigEndian.Uint64(data[12:20]))
+	if version >= 2 {
+		copy(t.AssignedIP6[:], data[20:36])
+	}
+	
+	return t, nil
+}
+
+// MarshalRekeyMessage serializes a rekey message
+func MarshalRekeyMessage(m *RekeyMessage) []byte {
+	buf := make([]byte, RekeyMessageSize)
+	buf[0] = m.Kind
+	buf[1] = m.Epoch
+	copy(buf[2:34], m.EphemeralPublicKey[:])
+	return buf
+}
+
+// UnmarshalRekeyMessage deserializes a rekey message
+func UnmarshalRekeyMessage(data []byte) (*RekeyMessage, error) {
+	if len(data) < RekeyMessageSize {
+		return nil, errors.New("rekey message too short")
+	}
+	
+	m := &RekeyMessage{}
+	m.Kind = data[0]
+	m.Epoch = data[1]
+	copy(m.EphemeralPublicKey[:], data[2:34])
+	
+	return m, nil
+}
+
 // IsValidPacketType checks if packet type is valid
 func IsValidPacketType(t uint8) bool {
 	switch t {
@@ -196,7 +858,15 @@ func IsValidPacketType(t uint8) bool {
 		PacketTypeHandshakeResponse,
 		PacketTypeData,
 		PacketTypeKeepAlive,
-		PacketTypeDisconnect:
+		PacketTypeDisconnect,
+		PacketTypeRekey,
+		PacketTypeCookieReply,
+		PacketTypeTicket,
+		PacketTypeVersionNegotiation,
+		PacketTypeFragment,
+		PacketTypePing,
+		PacketTypePong,
+		PacketTypeBatch:
 		return true
 	}
 	return false
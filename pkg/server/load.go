@@ -0,0 +1,56 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// handshakeLoad tracks how hard the server is being hit with handshakes
+type handshakeLoad struct {
+	inFlight    int32 // Connections that have not finished their handshake
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int // Handshake inits seen in the current one-second window
+	lastCount   int // Handshake inits seen in the previous window
+}
+
+// begin records a connection entering the handshake phase
+func (l *handshakeLoad) begin() {
+	atomic.AddInt32(&l.inFlight, 1)
+}
+
+// end records a connection leaving the handshake phase
+func (l *handshakeLoad) end() {
+	atomic.AddInt32(&l.inFlight, -1)
+}
+
+// record counts one handshake init and returns the current rate per second
+func (l *handshakeLoad) record() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.windowStart)
+	if elapsed >= time.Second {
+		if elapsed < 2*time.Second {
+			l.lastCount = l.count
+		} else {
+			l.lastCount = 0
+		}
+		l.count = 0
+		l.windowStart = now
+	}
+	l.count++
+
+	if l.lastCount > l.count {
+		return l.lastCount
+	}
+	return l.count
+}
+
+// underLoad reports whether either the handshake rate or the number of
+// concurrent handshakes has reached the threshold
+func (l *handshakeLoad) underLoad(rate int, threshold int) bool {
+	return rate >= threshold || int(atomic.LoadInt32(&l.inFlight)) >= threshold
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hydravpn/hydra/pkg/crypto"
+	"github.com/hydravpn/hydra/pkg/protocol"
+)
+
+// Peer is a client that is allowed to connect
+type Peer struct {
+	Name         string
+	PublicKey    [32]byte
+	PresharedKey [32]byte // Optional, zero if the peer has none
+}
+
+// PeerRegistry is the allowlist of client public keys
+type PeerRegistry struct {
+	peers      map[[32]byte]*Peer
+	timestamps map[[32]byte]protocol.Timestamp // Last accepted handshake per key, kept after removal
+	mu         sync.RWMutex
+}
+
+// NewPeerRegistry creates a registry holding the given peers
+func NewPeerRegistry(peers []Peer) *PeerRegistry {
+	r := &PeerRegistry{
+		peers:      make(map[[32]byte]*Peer),
+		timestamps: make(map[[32]byte]protocol.Timestamp),
+	}
+	for _, p := range peers {
+		r.Add(p)
+	}
+	return r
+}
+
+// Add adds a peer, replacing any existing entry with the same key
+func (r *PeerRegistry) Add(p Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[p.PublicKey] = &p
+}
+
+// Remove removes the peer with the given public key. Its last handshake
+// timestamp is kept, so inits captured before the removal cannot be
+// replayed if the key is added back.
+func (r *PeerRegistry) Remove(publicKey [32]byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.peers[publicKey]; !ok {
+		return false
+	}
+	delete(r.peers, publicKey)
+	return true
+}
+
+// CheckTimestamp records a handshake timestamp for the peer and reports
+// whether it is strictly later than the last one accepted, which rejects
+// replayed handshake inits
+func (r *PeerRegistry) CheckTimestamp(publicKey [32]byte, ts protocol.Timestamp) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.peers[publicKey]; !ok {
+		return false
+	}
+	if last, ok := r.timestamps[publicKey]; ok && !ts.After(last) {
+		return false
+	}
+	r.timestamps[publicKey] = ts
+	return true
+}
+
+// Lookup returns the peer with the given public key
+func (r *PeerRegistry) Lookup(publicKey [32]byte) (Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[publicKey]
+	if !ok {
+		return Peer{}, false
+	}
+	return *p, true
+}
+
+// List returns all peers sorted by name
+func (r *PeerRegistry) List() []Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make([]Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// Len returns the number of registered peers
+func (r *PeerRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.peers)
+}
+
+// LoadPeersFile reads peers from a file with one
+// "<public-key> <name> [<preshared-key>]" entry per line.
+// Blank lines and lines starting with '#' are ignored.
+func LoadPeersFile(path string) ([]Peer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var peers []Peer
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected \"<public-key> <name> [<preshared-key>]\"", path, lineNum)
+		}
+
+		publicKey, err := crypto.ParseKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		peer := Peer{Name: fields[1], PublicKey: publicKey}
+		if len(fields) == 3 {
+			peer.PresharedKey, err = crypto.ParseKey(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: pre-shared key: %w", path, lineNum, err)
+			}
+		}
+		peers = append(peers, peer)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hydravpn/hydra/pkg/protocol"
+)
+
+func TestPeerRegistryTimestamps(t *testing.T) {
+	peer := Peer{Name: "alice", PublicKey: [32]byte{1}}
+	r := NewPeerRegistry([]Peer{peer})
+
+	start := time.Now()
+	first := protocol.NewTimestamp(start)
+	if !r.CheckTimestamp(peer.PublicKey, first) {
+		t.Fatal("first handshake rejected")
+	}
+	if r.CheckTimestamp(peer.PublicKey, first) {
+		t.Fatal("replayed handshake accepted")
+	}
+	if r.CheckTimestamp(peer.PublicKey, protocol.NewTimestamp(start.Add(-time.Second))) {
+		t.Fatal("older handshake accepted")
+	}
+	if r.CheckTimestamp([32]byte{2}, first) {
+		t.Fatal("handshake of an unknown key accepted")
+	}
+
+	// Revoking and re-adding a peer must not reopen the replay window
+	if !r.Remove(peer.PublicKey) {
+		t.Fatal("Remove did not find the peer")
+	}
+	if r.CheckTimestamp(peer.PublicKey, protocol.NewTimestamp(start.Add(time.Second))) {
+		t.Fatal("handshake of a removed peer accepted")
+	}
+	r.Add(peer)
+	if r.CheckTimestamp(peer.PublicKey, first) {
+		t.Fatal("handshake from before the removal replayed")
+	}
+	if !r.CheckTimestamp(peer.PublicKey, protocol.NewTimestamp(start.Add(2*time.Second))) {
+		t.Fatal("fresh handshake after re-adding rejected")
+	}
+}
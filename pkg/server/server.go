@@ -4,10 +4,12 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hydravpn/hydra/pkg/crypto"
@@ -22,12 +24,21 @@ type Server struct {
 	transport  transport.Transport
 	listener   transport.Listener
 	keyPair    *crypto.KeyPair
+	peers      *PeerRegistry
+	cookies    *crypto.CookieChecker
+	handshakes *crypto.HeaderProtector // Unmasks handshake inits and masks our answers
+	tickets    *crypto.TicketSealer
+	load       handshakeLoad
 	tunDevice  *tun.TUNDevice
 	
 	sessions   map[uint64]*ClientSession
 	sessionsMu sync.RWMutex
 	
 	ipPool     *IPPool
+	ipPool6    *IPPool // nil when IPv6 is disabled
+	serverIP6  net.IP
+	
+	extensions []byte // Marshaled ClientConfig sent in handshake responses
 	
 	ctx        context.Context
 	cancel     context.CancelFunc
@@ -38,20 +49,158 @@ type Server struct {
 type Config struct {
 	ListenAddr    string
 	TransportType transport.TransportType
-	TUNConfig     *tun.Config
+	TUNConfig     *tun.Config // nil runs in tunnel-only mode
 	EnableNAT     bool
+	KeyPair       *crypto.KeyPair // Long-lived static key pinned by clients
+	PrivateKeyFile string         // Loaded (or created) when KeyPair is nil
+	Peers         []Peer          // Clients allowed to connect
+	PeersFile     string          // Additional peers, one "<public-key> <name>" per line
+	RekeyAfterTime  time.Duration // Rotate session keys after this long (0 disables)
+	RekeyAfterBytes uint64        // Rotate session keys after this much traffic (0 disables)
+	HandshakeLoadThreshold int    // Handshakes per second, or in flight, before cookies are required
+	RequirePostQuantum bool       // Drop clients that do not offer a hybrid ML-KEM handshake
+	CipherSuites  []crypto.CipherSuite // Suites accepted from clients
+	TicketLifetime time.Duration  // Validity of session resumption tickets (0 disables resumption)
+	Subnet6       *net.IPNet      // IPv6 prefix for clients (nil disables IPv6 in the tunnel)
+	ClientConfig  *protocol.ClientConfig // Network settings pushed to clients (nil pushes nothing)
+	Padding       protocol.PaddingPolicy // Data packet padding; if none, the client's choice is used
+	Compression   bool           // Let clients that ask for it compress data packets; sizes then leak content
 }
 
+// DefaultSubnet6 is the unique local IPv6 prefix handed out by default
+const DefaultSubnet6 = "fd48:7964:7261::/64"
+
+// packetHeadroom is the room left in front of IP packets read from the
+// TUN device for the header and crypto prefix, so they can be sealed in place
+const packetHeadroom = protocol.HeaderSize + crypto.PrefixSize
+
+// tunPacketOffset is where packets read from the TUN device start in their
+// buffer. It leaves room for a compression header as well, which sessions
+// that do not compress leave out of the frame.
+const tunPacketOffset = packetHeadroom + protocol.CompressionHeaderSize
+
+// poolRetryAfter is the reconnect hint given to clients refused for lack
+// of a free address
+const poolRetryAfter = 30 * time.Second
+
 // ClientSession represents a connected client
 type ClientSession struct {
 	ID           uint64
+	Peer         Peer
 	Conn         transport.Connection
-	CryptoSession *crypto.Session
+	Keyring      *crypto.Keyring
 	AssignedIP   net.IP
+	AssignedIP6  net.IP // nil for IPv4-only sessions
 	LastSeen     time.Time
+	Version      uint8  // Negotiated protocol version
+	Capabilities uint32 // Capability flags enabled for this session
+	Padding      protocol.PaddingPolicy // Padding of data packets, with CapabilityPadding
+	MaxPacketSize int // Largest packet sent to the client; bigger ones are fragmented
+	
+	writeMu      sync.Mutex
+	ticketIssued time.Time // When the client last got a resumption ticket
+	fragmentID   atomic.Uint32
+	reassembler  *protocol.Reassembler // Only used by the session's read loop
+	link         *protocol.LinkMonitor
+	batcher      *protocol.Batcher // Coalesces data sent to the client, with CapabilityBatching
+	compressor   *protocol.Compressor   // Only used by the TUN read loop, with CapabilityCompression
+	decompressor *protocol.Decompressor // Only used by the session's read loop
+	headers      *crypto.HeaderProtector // Masks headers after the handshake response; set before the session is registered
+	done         chan struct{} // Closed when the session's connection handler returns
+}
+
+// SessionStats describes the link quality of a connected client
+type SessionStats struct {
+	ID         uint64
+	Peer       string
+	AssignedIP net.IP
+	Link       protocol.LinkStats
+	
+	// Compression of data packets in each direction, zero unless the
+	// session compresses
+	CompressionSent     protocol.CompressionStats
+	CompressionReceived protocol.CompressionStats
+}
+
+// LinkStats returns the round trip time, jitter and loss measured with
+// pings to the client. They stay zero if the client does not do pings.
+func (cs *ClientSession) LinkStats() protocol.LinkStats {
+	return cs.link.Stats()
+}
+
+// CompressionStats returns how well data packets to and from the client
+// compressed. They stay zero if the session does not compress.
+func (cs *ClientSession) CompressionStats() (sent, received protocol.CompressionStats) {
+	if cs.compressor == nil {
+		return sent, received
+	}
+	return cs.compressor.Stats(), cs.decompressor.Stats()
+}
+
+// WritePacket sends a packet to the client, serializing concurrent writers
+func (cs *ClientSession) WritePacket(packet *protocol.Packet) error {
+	return cs.Write(packet.Marshal())
+}
+
+// Write sends an already serialized packet to the client, masking its
+// header if the session protects headers. data is modified in place.
+func (cs *ClientSession) Write(data []byte) error {
+	cs.writeMu.Lock()
+	defer cs.writeMu.Unlock()
+	if cs.headers != nil {
+		if err := cs.headers.Protect(data, packetHeadroom); err != nil {
+			return err
+		}
+	}
+	_, err := cs.Conn.Write(data)
+	return err
+}
+
+// unprotect removes header protection from a received packet in place
+func (cs *ClientSession) unprotect(data []byte) error {
+	if cs.headers == nil {
+		return nil
+	}
+	return cs.headers.Unprotect(data, packetHeadroom)
+}
+
+// writeSealed seals buf[packetHeadroom:] in place and sends it as a packet
+// of the given type
+func (cs *ClientSession) writeSealed(buf []byte, packetType uint8) error {
+	data, err := protocol.AppendSealedPacket(buf[:0], cs.Keyring, cs.Version, packetType, cs.ID, buf[packetHeadroom:])
+	if err != nil {
+		return err
+	}
+	return cs.Write(data)
 }
 
-// IPPool manages IP address allocation for clients
+// WriteFragments sends a data payload that does not fit in one packet as
+// a series of fragments
+func (cs *ClientSession) WriteFragments(payload []byte) error {
+	if cs.Capabilities&protocol.CapabilityFragmentation == 0 {
+		return fmt.Errorf("%d byte packet too large for the transport", len(payload))
+	}
+	
+	size := cs.MaxPacketSize - protocol.HeaderSize - cs.Keyring.Overhead()
+	fragments, err := protocol.Fragment(cs.fragmentID.Add(1), payload, size)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		packet, err := protocol.SealPacket(cs.Keyring, cs.Version, protocol.PacketTypeFragment, cs.ID, fragment)
+		if err != nil {
+			return err
+		}
+		if err := cs.WritePacket(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IPPool manages IP address allocation for clients. It works for IPv4
+// subnets and IPv6 prefixes; only the low 32 host bits of larger IPv6
+// prefixes are used.
 type IPPool struct {
 	baseIP   net.IP
 	subnet   *net.IPNet
@@ -77,18 +226,15 @@ func (p *IPPool) Allocate() (net.IP, error) {
 	
 	// Calculate available IPs in subnet
 	ones, bits := p.subnet.Mask.Size()
-	maxHosts := uint32(1 << (bits - ones))
+	maxHosts := uint64(1) << min(bits-ones, 32)
 	
-	for i := uint32(0); i < maxHosts-2; i++ {
-		hostNum := (p.nextHost + i) % (maxHosts - 1)
+	for i := uint64(0); i < maxHosts-2; i++ {
+		hostNum := uint32((uint64(p.nextHost) + i) % (maxHosts - 1))
 		if hostNum < 2 {
 			hostNum = 2
 		}
 		
-		ip := make(net.IP, 4)
-		baseInt := binary.BigEndian.Uint32(p.baseIP.To4())
-		binary.BigEndian.PutUint32(ip, baseInt+hostNum)
-		
+		ip := p.host(hostNum)
 		ipStr := ip.String()
 		if !p.used[ipStr] {
 			p.used[ipStr] = true
@@ -100,6 +246,27 @@ func (p *IPPool) Allocate() (net.IP, error) {
 	return nil, fmt.Errorf("IP pool exhausted")
 }
 
+// host returns the address of the given host number in the subnet
+func (p *IPPool) host(hostNum uint32) net.IP {
+	ip := make(net.IP, len(p.baseIP))
+	copy(ip, p.baseIP)
+	low := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(low, binary.BigEndian.Uint32(low)+hostNum)
+	return ip
+}
+
+// Reserve allocates a specific IP, as long as it is in the pool and free
+func (p *IPPool) Reserve(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	
+	if !p.subnet.Contains(ip) || p.used[ip.String()] {
+		return false
+	}
+	p.used[ip.String()] = true
+	return true
+}
+
 // Release releases an IP back to the pool
 func (p *IPPool) Release(ip net.IP) {
 	p.mu.Lock()
@@ -114,19 +281,77 @@ func DefaultConfig() *Config {
 		TransportType: transport.TransportWebSocket, // WebSocket for easier testing
 		TUNConfig:     tun.DefaultConfig(),
 		EnableNAT:     true,
+		RekeyAfterTime:  protocol.RekeyAfterTime,
+		RekeyAfterBytes: protocol.RekeyAfterBytes,
+		HandshakeLoadThreshold: 64,
+		CipherSuites:  crypto.DefaultCipherSuites(),
+		TicketLifetime: protocol.TicketLifetime,
+		Subnet6:       mustParseCIDR(DefaultSubnet6),
+		ClientConfig: &protocol.ClientConfig{
+			DNS:       []net.IP{net.ParseIP("1.1.1.1"), net.ParseIP("8.8.8.8")},
+			MTU:       1400,
+			KeepAlive: protocol.KeepAliveInterval,
+		},
 	}
 }
 
+// mustParseCIDR parses a constant CIDR
+func mustParseCIDR(s string) *net.IPNet {
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return subnet
+}
+
 // New creates a new VPN server
 func New(cfg *Config) (*Server, error) {
 	if cfg == nil {
 		cfg = DefaultConfig()
 	}
 	
-	// Generate server key pair
-	keyPair, err := crypto.GenerateKeyPair()
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate key pair: %w", err)
+	if len(cfg.CipherSuites) == 0 {
+		return nil, errors.New("at least one cipher suite must be enabled")
+	}
+	if err := cfg.Padding.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid padding policy: %w", err)
+	}
+	
+	// Use the configured static key, or generate one for this run
+	keyPair := cfg.KeyPair
+	if keyPair == nil && cfg.PrivateKeyFile != "" {
+		var created bool
+		var err error
+		keyPair, created, err = crypto.LoadOrCreateKeyPair(cfg.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load private key: %w", err)
+		}
+		if created {
+			log.Printf("Generated new private key in %s", cfg.PrivateKeyFile)
+		}
+	}
+	if keyPair == nil {
+		var err error
+		keyPair, err = crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key pair: %w", err)
+		}
+		log.Printf("Warning: No static key configured, generated a temporary one")
+	}
+	
+	// Load the peer allowlist
+	peers := NewPeerRegistry(cfg.Peers)
+	if cfg.PeersFile != "" {
+		filePeers, err := LoadPeersFile(cfg.PeersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load peers: %w", err)
+		}
+		for _, p := range filePeers {
+			peers.Add(p)
+		}
+	}
+	if peers.Len() == 0 {
+		log.Printf("Warning: No peers configured, all handshakes will be rejected")
 	}
 	
 	// Create transport
@@ -142,18 +367,56 @@ func New(cfg *Config) (*Server, error) {
 		t = transport.NewWebSocketTransport(nil)
 	}
 	
+	tickets, err := crypto.NewTicketSealer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ticket key: %w", err)
+	}
+	
 	// Create IP pool
 	_, subnet, _ := net.ParseCIDR("10.8.0.0/24")
 	ipPool := NewIPPool(subnet)
 	
+	// IPv6 pool, with the first host address for the server
+	var ipPool6 *IPPool
+	var serverIP6 net.IP
+	if cfg.Subnet6 != nil {
+		if cfg.Subnet6.IP.To4() != nil {
+			return nil, fmt.Errorf("IPv6 subnet %s is not an IPv6 prefix", cfg.Subnet6)
+		}
+		ipPool6 = NewIPPool(cfg.Subnet6)
+		serverIP6 = ipPool6.host(1)
+	}
+	
+	// Client configuration is the same for every session, so it is
+	// marshaled once
+	var extensions []byte
+	if cfg.ClientConfig != nil {
+		extensions, err = protocol.MarshalClientConfig(cfg.ClientConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client configuration: %w", err)
+		}
+	}
+	
+	handshakes, err := crypto.NewHandshakeProtector(keyPair.PublicKey, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive handshake protection keys: %w", err)
+	}
+	
 	ctx, cancel := context.WithCancel(context.Background())
 	
 	return &Server{
 		config:   cfg,
 		transport: t,
 		keyPair:  keyPair,
+		peers:    peers,
+		cookies:  crypto.NewCookieChecker(keyPair.PublicKey),
+		handshakes: handshakes,
+		tickets:  tickets,
 		sessions: make(map[uint64]*ClientSession),
 		ipPool:   ipPool,
+		ipPool6:  ipPool6,
+		serverIP6: serverIP6,
+		extensions: extensions,
 		ctx:      ctx,
 		cancel:   cancel,
 	}, nil
@@ -165,14 +428,13 @@ func (s *Server) Start() error {
 		s.config.ListenAddr, s.transport.Name())
 	
 	// Create TUN device for server
-	s.config.TUNConfig.LocalIP = net.ParseIP("10.8.0.1")
-	tunDev, err := tun.New(s.config.TUNConfig)
-	if err != nil {
+	if s.config.TUNConfig == nil {
+		log.Printf("No TUN device configured, running in tunnel-only mode")
+	} else if err := s.createTUN(); err != nil {
 		log.Printf("Warning: Failed to create TUN device: %v", err)
 		log.Printf("Running in tunnel-only mode (no system routing)")
 	} else {
-		s.tunDevice = tunDev
-		log.Printf("Created TUN interface: %s", tunDev.Name())
+		log.Printf("Created TUN interface: %s", s.tunDevice.Name())
 		
 		// Start reading from TUN
 		s.wg.Add(1)
@@ -195,6 +457,36 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// createTUN creates the server's TUN device on the first tunnel addresses
+func (s *Server) createTUN() error {
+	s.config.TUNConfig.LocalIP = net.ParseIP("10.8.0.1")
+	if s.ipPool6 != nil {
+		s.config.TUNConfig.LocalIP6 = s.serverIP6
+		s.config.TUNConfig.Subnet6 = s.config.Subnet6
+	}
+	tunDev, err := tun.New(s.config.TUNConfig)
+	if err != nil {
+		return err
+	}
+	s.tunDevice = tunDev
+	return nil
+}
+
+// Addr returns the address the server listens on, once started
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// PublicKey returns the server's static public key
+func (s *Server) PublicKey() [32]byte {
+	return s.keyPair.PublicKey
+}
+
+// Peers returns the registry of clients allowed to connect
+func (s *Server) Peers() *PeerRegistry {
+	return s.peers
+}
+
 // acceptLoop accepts incoming connections
 func (s *Server) acceptLoop() {
 	defer s.wg.Done()
@@ -227,100 +519,316 @@ func (s *Server) handleConnection(conn transport.Connection) {
 	defer s.wg.Done()
 	defer conn.Close()
 	
+	// Track the connection until its handshake completes
+	s.load.begin()
+	handshaking := true
+	defer func() {
+		if handshaking {
+			s.load.end()
+		}
+	}()
+	
 	// Wait for handshake init
 	buf := make([]byte, 4096)
-	n, err := conn.Read(buf)
+	initPacket, hsInit, masked, err := s.readHandshakeInit(conn, buf)
 	if err != nil {
-		log.Printf("Read handshake error: %v", err)
+		log.Printf("Handshake from %s failed: %v", conn.RemoteAddr(), err)
 		return
 	}
 	
-	// Parse packet
-	packet, err := protocol.UnmarshalPacket(buf[:n])
+	// Authenticate the client. A failure here means the client does not
+	// know our static key, so drop it without answering.
+	hs := crypto.NewResponderHandshake(s.keyPair)
+	defer hs.Destroy()
+	if hsInit.Flags&protocol.HandshakeFlagHybrid != 0 {
+		if err := hs.AcceptKEM(hsInit.KEMPublicKey); err != nil {
+			log.Printf("Handshake from %s rejected: %v", conn.RemoteAddr(), err)
+			return
+		}
+	} else if s.config.RequirePostQuantum {
+		log.Printf("Handshake from %s rejected: post-quantum key exchange required", conn.RemoteAddr())
+		return
+	}
+	if hsInit.Flags&protocol.HandshakeFlagResume != 0 {
+		hs.MixTicket(hsInit.Ticket)
+	}
+	hs.MixHeader(initPacket.Header.Marshal())
+	remoteStatic, err := hs.OpenInitStatic(hsInit.EphemeralPublicKey, hsInit.EncryptedStatic)
 	if err != nil {
-		log.Printf("Parse packet error: %v", err)
+		log.Printf("Handshake from %s rejected: %v", conn.RemoteAddr(), err)
 		return
 	}
 	
-	if packet.Header.Type != protocol.PacketTypeHandshakeInit {
-		log.Printf("Expected handshake init, got %d", packet.Header.Type)
+	// Only registered peers get an answer
+	peer, ok := s.peers.Lookup(remoteStatic)
+	if !ok {
+		log.Printf("Handshake from %s rejected: unknown peer %s", conn.RemoteAddr(), crypto.EncodeKey(remoteStatic))
 		return
 	}
 	
-	// Parse handshake init
-	hsInit, err := protocol.UnmarshalHandshakeInit(packet.Payload)
+	// Without the peer's pre-shared key the rest of the init cannot be
+	// opened, and the client gets no answer at all
+	hs.SetPresharedKey(peer.PresharedKey)
+	initData, err := hs.OpenInitPayload(hsInit.EncryptedPayload[:])
 	if err != nil {
-		log.Printf("Parse handshake init error: %v", err)
+		log.Printf("Handshake from peer %s rejected: pre-shared key mismatch", peer.Name)
 		return
 	}
 	
-	// Compute shared secret
-	sharedSecret, err := crypto.ComputeSharedSecret(s.keyPair.PrivateKey, hsInit.ClientPublicKey)
+	initPayload, err := protocol.UnmarshalInitPayload(initData, hsInit.Version)
 	if err != nil {
-		log.Printf("Compute shared secret error: %v", err)
+		log.Printf("Handshake from peer %s rejected: %v", peer.Name, err)
 		return
 	}
 	
-	// Derive session keys using deterministic salt from shared secret
-	// Both client and server will derive the same salt
-	salt := sharedSecret[:] // Use shared secret as salt (it's already shared)
-	cryptoSession, err := crypto.DeriveSessionKeys(sharedSecret, false, salt)
-	if err != nil {
-		log.Printf("Derive keys error: %v", err)
+	// Reject stale and replayed handshakes
+	timestamp := initPayload.Timestamp
+	if skew := time.Since(timestamp.Time()); skew > protocol.HandshakeTimestampWindow || skew < -protocol.HandshakeTimestampWindow {
+		log.Printf("Handshake from peer %s rejected: timestamp off by %v", peer.Name, skew)
+		return
+	}
+	if !s.peers.CheckTimestamp(peer.PublicKey, timestamp) {
+		log.Printf("Handshake from peer %s rejected: replayed timestamp", peer.Name)
+		return
+	}
+	
+	// Settle on the newest version both sides speak. The init must already
+	// use it, otherwise a forged version negotiation forced a downgrade.
+	version, ok := protocol.NegotiateVersion(initPayload.MinVersion, initPayload.MaxVersion, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+	if !ok {
+		log.Printf("Handshake from peer %s rejected: no common protocol version in %d-%d", peer.Name, initPayload.MinVersion, initPayload.MaxVersion)
+		s.writeHandshake(conn, protocol.NewVersionNegotiationPacket(), masked)
+		return
+	}
+	if initPacket.Header.Version != version {
+		log.Printf("Handshake from peer %s rejected: version %d used instead of %d", peer.Name, initPacket.Header.Version, version)
 		return
 	}
+	capabilities := initPayload.Capabilities & s.capabilities() & protocol.VersionCapabilities(version)
 	
-	// Generate session ID
-	var sessionID uint64
-	binary.Read(rand.Reader, binary.BigEndian, &sessionID)
+	// Our padding policy wins, otherwise the client gets what it asked for
+	padding := s.config.Padding
+	if padding.Mode == protocol.PaddingNone && initPayload.Padding.Validate() == nil {
+		padding = initPayload.Padding
+	}
+	if capabilities&protocol.CapabilityPadding == 0 || padding.Mode == protocol.PaddingNone {
+		capabilities &^= protocol.CapabilityPadding
+		padding = protocol.PaddingPolicy{}
+	}
 	
-	// Allocate IP for client
-	clientIP, err := s.ipPool.Allocate()
+	// Pick the first offered cipher suite we accept
+	var offered []crypto.CipherSuite
+	for _, id := range initPayload.CipherSuites {
+		if id == 0 {
+			break
+		}
+		offered = append(offered, crypto.CipherSuite(id))
+	}
+	suite, err := crypto.SelectCipherSuite(offered, s.config.CipherSuites)
 	if err != nil {
-		log.Printf("IP allocation error: %v", err)
+		log.Printf("Handshake from peer %s rejected: no common cipher suite in %v", peer.Name, offered)
 		return
 	}
 	
-	// Create session
-	session := &ClientSession{
-		ID:            sessionID,
-		Conn:          conn,
-		CryptoSession: cryptoSession,
-		AssignedIP:    clientIP,
-		LastSeen:      time.Now(),
+	// Pick up where the client left off if it has a valid ticket
+	var refusal *protocol.DisconnectMessage
+	sessionID, clientIP, clientIP6, resumed := s.resumeSession(peer, hsInit, capabilities&protocol.CapabilityIPv6 != 0)
+	if !resumed {
+		// Generate session ID
+		binary.Read(rand.Reader, binary.BigEndian, &sessionID)
+		
+		// Allocate IP for client. Without one the handshake still completes,
+		// so the client can be told why in an authenticated disconnect.
+		clientIP, err = s.ipPool.Allocate()
+		if err != nil {
+			log.Printf("Refusing peer %s: %v", peer.Name, err)
+			refusal = &protocol.DisconnectMessage{Reason: protocol.DisconnectPoolExhausted, RetryAfter: poolRetryAfter}
+			capabilities &^= protocol.CapabilityIPv6
+		}
 	}
 	
-	s.sessionsMu.Lock()
-	s.sessions[sessionID] = session
-	s.sessionsMu.Unlock()
+	// Dual-stack clients also get an IPv6 address
+	if capabilities&protocol.CapabilityIPv6 != 0 && clientIP6 == nil {
+		clientIP6, err = s.ipPool6.Allocate()
+		if err != nil {
+			log.Printf("IPv6 allocation error: %v", err)
+			capabilities &^= protocol.CapabilityIPv6
+		}
+	}
 	
+	// The session ID and IP stay ours unless a resumed connection took
+	// them over, in which case it has replaced us in the session table
+	var session *ClientSession
+	registered := false
 	defer func() {
 		s.sessionsMu.Lock()
-		delete(s.sessions, sessionID)
+		owner := !registered || s.sessions[sessionID] == session
+		if registered && owner {
+			delete(s.sessions, sessionID)
+		}
 		s.sessionsMu.Unlock()
-		s.ipPool.Release(clientIP)
-		log.Printf("Session %d closed, released IP %s", sessionID, clientIP)
+		
+		if session != nil {
+			if session.batcher != nil {
+				session.batcher.Stop()
+			}
+			session.Keyring.Destroy()
+			close(session.done)
+		}
+		if owner && clientIP == nil {
+			log.Printf("Session %d closed", sessionID)
+		} else if owner {
+			s.ipPool.Release(clientIP)
+			if clientIP6 != nil {
+				s.ipPool6.Release(clientIP6)
+			}
+			log.Printf("Session %d closed, released IP %s", sessionID, clientIP)
+		} else {
+			log.Printf("Session %d handed over to a resumed connection", sessionID)
+		}
 	}()
 	
-	// Send handshake response
-	hsResp := &protocol.HandshakeResponse{
-		ServerPublicKey: s.keyPair.PublicKey,
-		SessionID:       sessionID,
-		Subnet:          24,
+	// Seal session parameters into the handshake response
+	params := &protocol.SessionParams{
+		SessionID:   sessionID,
+		Subnet:      24,
+		CipherSuite: uint8(suite),
+		Version:      version,
+		Capabilities: capabilities,
+		Padding:      padding,
+	}
+	copy(params.AssignedIP[:], clientIP.To4())
+	copy(params.ServerIP[:], net.ParseIP("10.8.0.1").To4())
+	if clientIP6 != nil {
+		copy(params.AssignedIP6[:], clientIP6)
+		copy(params.ServerIP6[:], s.serverIP6)
+		ones, _ := s.config.Subnet6.Mask.Size()
+		params.Prefix6 = uint8(ones)
+	}
+	
+	// Hybrid clients get a KEM ciphertext back, and clients that take
+	// extensions get the pushed configuration sealed after the params
+	hsResp := &protocol.HandshakeResponse{Version: version, Flags: hsInit.Flags & protocol.HandshakeFlagHybrid}
+	sealed := protocol.MarshalSessionParams(params)
+	if capabilities&protocol.CapabilityExtensions != 0 {
+		hsResp.Flags |= protocol.HandshakeFlagExtensions
+		hsResp.ExtensionsSize = uint16(len(s.extensions))
+		sealed = append(sealed, s.extensions...)
+	}
+	respHeader := protocol.NewHeader(protocol.PacketTypeHandshakeResponse, sessionID, hsResp.Size())
+	respHeader.Version = version
+	hs.MixHeader(respHeader.Marshal())
+	
+	ephemeral, kemCiphertext, encryptedParams, err := hs.SealResponse(sealed)
+	if err != nil {
+		log.Printf("Seal handshake response error: %v", err)
+		return
 	}
-	copy(hsResp.AssignedIP[:], clientIP.To4())
-	copy(hsResp.ServerIP[:], net.ParseIP("10.8.0.1").To4())
+	hsResp.EphemeralPublicKey = ephemeral
+	hsResp.KEMCiphertext = kemCiphertext
+	hsResp.EncryptedParams = encryptedParams
 	rand.Read(hsResp.RandomPadding[:])
 	
-	respPayload := protocol.MarshalHandshakeResponse(hsResp)
-	respPacket := protocol.NewPacket(protocol.PacketTypeHandshakeResponse, sessionID, respPayload)
+	keyring, err := hs.Keyring(suite)
+	if err != nil {
+		log.Printf("Derive keys error: %v", err)
+		return
+	}
+	var headers *crypto.HeaderProtector
+	if capabilities&protocol.CapabilityHeaderProtection != 0 {
+		if headers, err = hs.HeaderProtector(); err != nil {
+			log.Printf("Derive header protection keys error: %v", err)
+			keyring.Destroy()
+			return
+		}
+	}
+	hs.Destroy()
 	
-	if _, err := conn.Write(respPacket.Marshal()); err != nil {
+	// Create session
+	session = &ClientSession{
+		ID:            sessionID,
+		Peer:          peer,
+		Conn:          conn,
+		Keyring:       keyring,
+		AssignedIP:    clientIP,
+		AssignedIP6:   clientIP6,
+		LastSeen:      time.Now(),
+		Version:       version,
+		Capabilities:  capabilities,
+		Padding:       padding,
+		MaxPacketSize: transport.MessageLimit(conn, protocol.BufferSize),
+		reassembler:   protocol.NewReassembler(),
+		link:          protocol.NewLinkMonitor(),
+		done:          make(chan struct{}),
+	}
+	if capabilities&protocol.CapabilityBatching != 0 {
+		limit := session.MaxPacketSize - protocol.HeaderSize - keyring.Overhead()
+		session.batcher = protocol.NewBatcher(packetHeadroom, limit, session.writeSealed)
+	}
+	if capabilities&protocol.CapabilityCompression != 0 {
+		session.compressor = protocol.NewCompressor()
+		session.decompressor = protocol.NewDecompressor()
+	}
+	
+	respPacket := &protocol.Packet{Header: respHeader, Payload: protocol.MarshalHandshakeResponse(hsResp)}
+	respData := respPacket.Marshal()
+	if masked {
+		if err := s.handshakes.Protect(respData, protocol.HeaderSize); err != nil {
+			log.Printf("Mask handshake response error: %v", err)
+			return
+		}
+	}
+	if err := session.Write(respData); err != nil {
 		log.Printf("Write handshake response error: %v", err)
 		return
 	}
 	
-	log.Printf("Session %d established, assigned IP %s", sessionID, clientIP)
+	// Every packet after the handshake response has its header masked.
+	// Sessions are told apart by their transport connection, so the
+	// masked session ID is not needed to route packets.
+	session.headers = headers
+	
+	s.load.end()
+	handshaking = false
+	
+	// Refused clients get the reason and a moment to acknowledge it. They
+	// have no address, so they never enter the session table, and a
+	// stopping server does not wait for them.
+	if refusal != nil {
+		if err := s.sendDisconnect(session, refusal); err != nil {
+			log.Printf("Session %d disconnect error: %v", sessionID, err)
+			return
+		}
+		closer := time.AfterFunc(protocol.CloseTimeout, func() { conn.Close() })
+		defer closer.Stop()
+		stopped := context.AfterFunc(s.ctx, func() { conn.Close() })
+		defer stopped()
+		s.awaitDisconnect(session)
+		return
+	}
+	
+	// Only a complete session that the client knows about gets packets
+	// from the TUN device
+	s.sessionsMu.Lock()
+	s.sessions[sessionID] = session
+	registered = true
+	s.sessionsMu.Unlock()
+	
+	mode := "classic"
+	if hs.Hybrid() {
+		mode = "hybrid post-quantum"
+	}
+	state := "established"
+	if resumed {
+		state = "resumed"
+	}
+	addrs := clientIP.String()
+	if clientIP6 != nil {
+		addrs += " and " + clientIP6.String()
+	}
+	log.Printf("Session %d %s for peer %s, assigned IP %s (%s key exchange, %s)", sessionID, state, peer.Name, addrs, mode, suite)
+	
+	s.maybeIssueTicket(session)
 	
 	// Handle data packets
 	for {
@@ -330,53 +838,502 @@ func (s *Server) handleConnection(conn transport.Connection) {
 		default:
 		}
 		
-		n, err := conn.Read(buf)
+		buf := protocol.GetBuffer()
+		n, err := conn.Read(*buf)
 		if err != nil {
+			protocol.PutBuffer(buf)
 			log.Printf("Session %d read error: %v", sessionID, err)
 			return
 		}
 		
-		packet, err := protocol.UnmarshalPacket(buf[:n])
-		if err != nil {
-			log.Printf("Session %d parse error: %v", sessionID, err)
+		if err := session.unprotect((*buf)[:n]); err != nil {
+			protocol.PutBuffer(buf)
+			log.Printf("Session %d dropped packet: %v", sessionID, err)
 			continue
 		}
+		done := s.handlePacket(session, (*buf)[:n])
+		protocol.PutBuffer(buf)
+		if done {
+			return
+		}
+	}
+}
+
+// handlePacket processes one packet of an established session, decrypting
+// it in place, and reports whether the client has disconnected. Header
+// protection must already be removed.
+func (s *Server) handlePacket(session *ClientSession, data []byte) bool {
+	var packet protocol.Packet
+	if err := protocol.UnmarshalPacketInto(&packet, data); err != nil {
+		log.Printf("Session %d parse error: %v", session.ID, err)
+		return false
+	}
+	if packet.Header.Version != session.Version {
+		log.Printf("Session %d dropped packet of type %d: version %d", session.ID, packet.Header.Type, packet.Header.Version)
+		return false
+	}
+	if len(packet.Payload) < crypto.PrefixSize {
+		log.Printf("Session %d dropped packet of type %d: %v", session.ID, packet.Header.Type, crypto.ErrCiphertextTooShort)
+		return false
+	}
+	
+	// Every packet is authenticated, header included, so forged
+	// control packets are dropped here
+	plaintext, err := protocol.OpenPacketAppend(packet.Payload[crypto.PrefixSize:crypto.PrefixSize], session.Keyring, &packet)
+	if err != nil {
+		log.Printf("Session %d dropped packet of type %d: %v", session.ID, packet.Header.Type, err)
+		return false
+	}
+	
+	session.LastSeen = time.Now()
+	
+	switch packet.Header.Type {
+	case protocol.PacketTypeData:
+		s.handleData(session, plaintext)
+		
+	case protocol.PacketTypeFragment:
+		if session.Capabilities&protocol.CapabilityFragmentation == 0 {
+			log.Printf("Session %d dropped fragment: fragmentation not negotiated", session.ID)
+			return false
+		}
+		payload, err := session.reassembler.Add(plaintext)
+		if err != nil {
+			log.Printf("Session %d dropped fragment: %v", session.ID, err)
+			return false
+		}
+		if payload != nil {
+			s.handleData(session, payload)
+		}
+		
+	case protocol.PacketTypeBatch:
+		if session.Capabilities&protocol.CapabilityBatching == 0 {
+			log.Printf("Session %d dropped batch: batching not negotiated", session.ID)
+			return false
+		}
+		entries, err := protocol.UnmarshalBatch(plaintext)
+		if err != nil {
+			log.Printf("Session %d dropped batch: %v", session.ID, err)
+			return false
+		}
+		for _, entry := range entries {
+			s.handleData(session, entry)
+		}
+		
+	case protocol.PacketTypeKeepAlive:
+		// Send keepalive response
+		kaPacket, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypeKeepAlive, session.ID, nil)
+		if err != nil {
+			log.Printf("Session %d keepalive error: %v", session.ID, err)
+			return false
+		}
+		session.WritePacket(kaPacket)
+		
+		s.maybeIssueTicket(session)
+		
+	case protocol.PacketTypePing:
+		if session.Capabilities&protocol.CapabilityPing == 0 {
+			log.Printf("Session %d dropped ping: pings not negotiated", session.ID)
+			return false
+		}
+		s.handlePing(session, plaintext)
+		s.maybeIssueTicket(session)
 		
-		session.LastSeen = time.Now()
+	case protocol.PacketTypePong:
+		pong, err := protocol.UnmarshalPingMessage(plaintext)
+		if err != nil {
+			log.Printf("Session %d dropped pong: %v", session.ID, err)
+			return false
+		}
+		session.link.HandlePong(pong)
 		
-		switch packet.Header.Type {
-		case protocol.PacketTypeData:
-			// Decrypt payload
-			plaintext, err := cryptoSession.Decrypt(packet.Payload)
-			if err != nil {
-				log.Printf("Session %d decrypt error: %v", sessionID, err)
+	case protocol.PacketTypeRekey:
+		s.handleRekey(session, plaintext)
+		
+	case protocol.PacketTypeDisconnect:
+		msg, err := protocol.UnmarshalDisconnectMessage(plaintext)
+		if err != nil {
+			log.Printf("Session %d disconnected by client: %v", session.ID, err)
+			return true
+		}
+		log.Printf("Session %d disconnected by client: %s", session.ID, msg)
+		return true
+	}
+	
+	return false
+}
+
+// sendDisconnect tells the client why its session ends
+func (s *Server) sendDisconnect(session *ClientSession, msg *protocol.DisconnectMessage) error {
+	packet, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypeDisconnect, session.ID, protocol.MarshalDisconnectMessage(msg))
+	if err != nil {
+		return err
+	}
+	return session.WritePacket(packet)
+}
+
+// awaitDisconnect reads packets of a refused session until the client
+// acknowledges the disconnect or the connection is closed. Nothing else
+// the client sends is acted on.
+func (s *Server) awaitDisconnect(session *ClientSession) {
+	buf := protocol.GetBuffer()
+	defer protocol.PutBuffer(buf)
+	
+	for {
+		n, err := session.Conn.Read(*buf)
+		if err != nil {
+			return
+		}
+		if session.unprotect((*buf)[:n]) != nil {
+			continue
+		}
+		var packet protocol.Packet
+		if err := protocol.UnmarshalPacketInto(&packet, (*buf)[:n]); err != nil || packet.Header.Type != protocol.PacketTypeDisconnect {
+			continue
+		}
+		if s.handlePacket(session, (*buf)[:n]) {
+			return
+		}
+	}
+}
+
+// closeSessions sends each session a disconnect and waits up to
+// protocol.CloseTimeout for the clients to acknowledge it. Connections
+// still open after that are closed.
+func (s *Server) closeSessions(sessions []*ClientSession, msg *protocol.DisconnectMessage) {
+	for _, session := range sessions {
+		if err := s.sendDisconnect(session, msg); err != nil {
+			log.Printf("Session %d disconnect error: %v", session.ID, err)
+		}
+	}
+	
+	timeout := time.NewTimer(protocol.CloseTimeout)
+	defer timeout.Stop()
+	expired := false
+	for _, session := range sessions {
+		if !expired {
+			select {
+			case <-session.done:
 				continue
+			case <-timeout.C:
+				expired = true
 			}
-			
-			// Write to TUN device
-			if s.tunDevice != nil {
-				if _, err := s.tunDevice.Write(plaintext); err != nil {
-					log.Printf("TUN write error: %v", err)
-				}
-			}
-			
-		case protocol.PacketTypeKeepAlive:
-			// Send keepalive response
-			kaPacket := protocol.NewPacket(protocol.PacketTypeKeepAlive, sessionID, nil)
-			conn.Write(kaPacket.Marshal())
-			
-		case protocol.PacketTypeDisconnect:
-			log.Printf("Session %d disconnected by client", sessionID)
+		}
+		session.Conn.Close()
+	}
+}
+
+// RevokePeer removes a peer from the registry and closes its sessions,
+// telling the clients not to reconnect. It reports whether the peer was
+// registered.
+func (s *Server) RevokePeer(publicKey [32]byte) bool {
+	removed := s.peers.Remove(publicKey)
+	
+	var sessions []*ClientSession
+	s.sessionsMu.RLock()
+	for _, session := range s.sessions {
+		if session.Peer.PublicKey == publicKey {
+			sessions = append(sessions, session)
+		}
+	}
+	s.sessionsMu.RUnlock()
+	
+	s.closeSessions(sessions, &protocol.DisconnectMessage{Reason: protocol.DisconnectKeyRejected})
+	return removed
+}
+
+// handlePing answers a client's ping, and pings back so the server gets
+// round trip samples of its own at the client's pace
+func (s *Server) handlePing(session *ClientSession, plaintext []byte) {
+	ping, err := protocol.UnmarshalPingMessage(plaintext)
+	if err != nil {
+		log.Printf("Session %d dropped ping: %v", session.ID, err)
+		return
+	}
+	
+	pong, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypePong, session.ID, protocol.MarshalPingMessage(ping))
+	if err != nil {
+		log.Printf("Session %d pong error: %v", session.ID, err)
+		return
+	}
+	session.WritePacket(pong)
+	
+	ownPing, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypePing, session.ID, protocol.MarshalPingMessage(session.link.NextPing()))
+	if err != nil {
+		log.Printf("Session %d ping error: %v", session.ID, err)
+		return
+	}
+	session.WritePacket(ownPing)
+}
+
+// SessionStats returns the link statistics of every connected client
+func (s *Server) SessionStats() []SessionStats {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	
+	stats := make([]SessionStats, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sent, received := session.CompressionStats()
+		stats = append(stats, SessionStats{
+			ID:                  session.ID,
+			Peer:                session.Peer.Name,
+			AssignedIP:          session.AssignedIP,
+			Link:                session.LinkStats(),
+			CompressionSent:     sent,
+			CompressionReceived: received,
+		})
+	}
+	return stats
+}
+
+// handleData writes the IP packet in a data payload to the TUN device
+func (s *Server) handleData(session *ClientSession, payload []byte) {
+	if session.Capabilities&protocol.CapabilityPadding != 0 {
+		var err error
+		if payload, err = protocol.StripPadding(payload); err != nil {
+			log.Printf("Session %d dropped data packet: %v", session.ID, err)
 			return
 		}
 	}
+	if session.decompressor != nil {
+		var err error
+		if payload, err = session.decompressor.Decompress(payload); err != nil {
+			log.Printf("Session %d dropped data packet: %v", session.ID, err)
+			return
+		}
+	}
+	
+	// Write to TUN device
+	if s.tunDevice != nil {
+		if _, err := s.tunDevice.Write(payload); err != nil {
+			log.Printf("TUN write error: %v", err)
+		}
+	}
+	
+	s.maybeRekey(session)
+}
+
+// capabilities returns the capability flags the server enables
+func (s *Server) capabilities() uint32 {
+	var capabilities uint32 = protocol.SupportedCapabilities
+	if s.config.TicketLifetime <= 0 {
+		capabilities &^= protocol.CapabilityResumption
+	}
+	if s.ipPool6 == nil {
+		capabilities &^= protocol.CapabilityIPv6
+	}
+	if len(s.extensions) == 0 {
+		capabilities &^= protocol.CapabilityExtensions
+	}
+	if !s.config.Compression {
+		capabilities &^= protocol.CapabilityCompression
+	}
+	return capabilities
+}
+
+// resumeSession restores the session ID and addresses recorded in the
+// client's resumption ticket. If the session is still registered, typically
+// because the server has not yet noticed the old connection dying, the new
+// connection takes it over and the old one is closed. The IPv6 address is
+// only kept if want6 is set; it is nil if the client needs a new one.
+func (s *Server) resumeSession(peer Peer, hsInit *protocol.HandshakeInit, want6 bool) (uint64, net.IP, net.IP, bool) {
+	if hsInit.Flags&protocol.HandshakeFlagResume == 0 || s.config.TicketLifetime <= 0 {
+		return 0, nil, nil, false
+	}
+	
+	contents, err := s.tickets.Open(hsInit.Ticket, peer.PublicKey)
+	if err != nil {
+		log.Printf("Resumption for peer %s refused: %v", peer.Name, err)
+		return 0, nil, nil, false
+	}
+	state, err := protocol.UnmarshalTicketState(contents, hsInit.Version)
+	if err != nil {
+		log.Printf("Resumption for peer %s refused: %v", peer.Name, err)
+		return 0, nil, nil, false
+	}
+	if time.Now().Unix() > state.Expiry {
+		log.Printf("Resumption for peer %s refused: ticket expired", peer.Name)
+		return 0, nil, nil, false
+	}
+	ip := net.IP(state.AssignedIP[:]).To4()
+	var ip6 net.IP
+	if state.AssignedIP6 != [16]byte{} {
+		ip6 = net.IP(state.AssignedIP6[:])
+	}
+	
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	
+	if old, ok := s.sessions[state.SessionID]; ok {
+		if old.Peer.PublicKey != peer.PublicKey || !old.AssignedIP.Equal(ip) {
+			return 0, nil, nil, false
+		}
+		delete(s.sessions, state.SessionID)
+		old.Conn.Close()
+		
+		// The old session's addresses are ours now
+		ip6 = old.AssignedIP6
+		if ip6 != nil && !want6 {
+			s.ipPool6.Release(ip6)
+			ip6 = nil
+		}
+		return state.SessionID, ip, ip6, true
+	}
+	
+	if !s.ipPool.Reserve(ip) {
+		log.Printf("Resumption for peer %s refused: IP %s no longer available", peer.Name, ip)
+		return 0, nil, nil, false
+	}
+	if ip6 != nil && (!want6 || !s.ipPool6.Reserve(ip6)) {
+		// A new IPv6 address is allocated if the client still wants one
+		ip6 = nil
+	}
+	return state.SessionID, ip, ip6, true
+}
+
+// maybeIssueTicket sends the client a fresh resumption ticket once the
+// last one has used up half of its lifetime
+func (s *Server) maybeIssueTicket(session *ClientSession) {
+	lifetime := s.config.TicketLifetime
+	if session.Capabilities&protocol.CapabilityResumption == 0 || time.Since(session.ticketIssued) < lifetime/2 {
+		return
+	}
+	
+	state := &protocol.TicketState{
+		SessionID: session.ID,
+		Expiry:    time.Now().Add(lifetime).Unix(),
+	}
+	copy(state.AssignedIP[:], session.AssignedIP.To4())
+	copy(state.AssignedIP6[:], session.AssignedIP6)
+	
+	ticket, err := s.tickets.Seal(protocol.MarshalTicketState(state, session.Version), session.Peer.PublicKey)
+	if err != nil {
+		log.Printf("Session %d ticket error: %v", session.ID, err)
+		return
+	}
+	packet, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypeTicket, session.ID, ticket)
+	if err != nil {
+		log.Printf("Session %d ticket error: %v", session.ID, err)
+		return
+	}
+	if err := session.WritePacket(packet); err != nil {
+		log.Printf("Session %d ticket error: %v", session.ID, err)
+		return
+	}
+	session.ticketIssued = time.Now()
+}
+
+// maxHandshakeAttempts bounds the cookie round trips on one connection
+const maxHandshakeAttempts = 3
+
+// readHandshakeInit waits for a handshake init carrying a valid MAC1 and
+// returns it along with the packet it arrived in, and whether its header
+// was masked. Only version 1 clients send inits in the clear; our answers
+// are masked whenever the init was.
+// While the server is under load, the client first gets a cookie reply
+// and has to retry with a matching MAC2 before any DH work is done.
+func (s *Server) readHandshakeInit(conn transport.Connection, buf []byte) (*protocol.Packet, *protocol.HandshakeInit, bool, error) {
+	src := []byte(remoteHost(conn.RemoteAddr()))
+	
+	for attempt := 0; attempt < maxHandshakeAttempts; attempt++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("read handshake: %w", err)
+		}
+		
+		masked := !isLegacyInit(buf[:n])
+		if masked {
+			if err := s.handshakes.Unprotect(buf[:n], protocol.HeaderSize); err != nil {
+				return nil, nil, false, fmt.Errorf("unmask handshake: %w", err)
+			}
+		}
+		
+		// Parse packet
+		packet, err := protocol.UnmarshalPacket(buf[:n])
+		if errors.Is(err, protocol.ErrUnsupportedVersion) {
+			// Tell the client which versions we speak so it can retry
+			if err := s.writeHandshake(conn, protocol.NewVersionNegotiationPacket(), masked); err != nil {
+				return nil, nil, false, fmt.Errorf("write version negotiation: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("parse packet: %w", err)
+		}
+		
+		if packet.Header.Type != protocol.PacketTypeHandshakeInit {
+			return nil, nil, false, fmt.Errorf("expected handshake init, got %d", packet.Header.Type)
+		}
+		
+		// Parse handshake init
+		hsInit, err := protocol.UnmarshalHandshakeInit(packet.Payload, packet.Header.Version)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("parse handshake init: %w", err)
+		}
+		msg := packet.Payload[:hsInit.Size()]
+		
+		// Cheap check that the client knows our public key
+		if !s.cookies.CheckMAC1(msg) {
+			return nil, nil, false, errors.New("invalid MAC1")
+		}
+		
+		rate := s.load.record()
+		if !s.load.underLoad(rate, s.config.HandshakeLoadThreshold) || s.cookies.CheckMAC2(msg, src) {
+			return packet, hsInit, masked, nil
+		}
+		
+		// Busy: hand out a cookie instead of doing the handshake
+		nonce, encryptedCookie, err := s.cookies.CreateReply(msg, src)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("create cookie reply: %w", err)
+		}
+		reply := &protocol.CookieReply{Nonce: nonce, EncryptedCookie: encryptedCookie}
+		replyPacket := protocol.NewPacket(protocol.PacketTypeCookieReply, 0, protocol.MarshalCookieReply(reply))
+		if err := s.writeHandshake(conn, replyPacket, masked); err != nil {
+			return nil, nil, false, fmt.Errorf("write cookie reply: %w", err)
+		}
+	}
+	
+	return nil, nil, false, errors.New("too many handshake attempts")
+}
+
+// isLegacyInit reports whether data is a handshake init of a version that
+// sends it in the clear. A masked init only parses as one by chance, with
+// a probability of about 2^-48.
+func isLegacyInit(data []byte) bool {
+	var packet protocol.Packet
+	if err := protocol.UnmarshalPacketInto(&packet, data); err != nil {
+		return false
+	}
+	return packet.Header.Type == protocol.PacketTypeHandshakeInit && packet.Header.Version <= protocol.LegacyHandshakeVersion
+}
+
+// writeHandshake sends a packet answering a handshake init, masking its
+// header if the init was masked
+func (s *Server) writeHandshake(conn transport.Connection, packet *protocol.Packet, masked bool) error {
+	data := packet.Marshal()
+	if masked {
+		if err := s.handshakes.Protect(data, protocol.HeaderSize); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write(data)
+	return err
+}
+
+// remoteHost returns the host part of a remote address, which cookies are bound to
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
 
 // tunReadLoop reads packets from TUN and sends to clients
 func (s *Server) tunReadLoop() {
 	defer s.wg.Done()
 	
-	buf := make([]byte, 2048)
+	bufferSize := tunPacketOffset + s.tunDevice.MTU()
 	
 	for {
 		select {
@@ -385,40 +1342,156 @@ func (s *Server) tunReadLoop() {
 		default:
 		}
 		
-		n, err := s.tunDevice.Read(buf)
+		buf := protocol.GetBufferFor(bufferSize)
+		n, err := s.tunDevice.Read((*buf)[tunPacketOffset:])
 		if err != nil {
+			protocol.PutBuffer(buf)
 			if s.ctx.Err() != nil {
 				return
 			}
 			log.Printf("TUN read error: %v", err)
 			continue
 		}
+		ipPacket := (*buf)[tunPacketOffset : tunPacketOffset+n]
 		
 		// Parse IP header to find destination
-		if n < 20 {
+		destIP := tun.PacketDestination(ipPacket)
+		if destIP == nil {
+			protocol.PutBuffer(buf)
 			continue
 		}
 		
-		// IPv4 destination is at bytes 16-19
-		destIP := net.IP(buf[16:20])
+		// Send outside the session table lock, so a slow client does not
+		// hold up handshakes and other sessions
+		if session := s.sessionByIP(destIP); session != nil {
+			s.sendTUNPacket(session, *buf, n)
+		}
+		protocol.PutBuffer(buf)
+	}
+}
+
+// sessionByIP returns the session assigned ip, or nil if there is none
+func (s *Server) sessionByIP(ip net.IP) *ClientSession {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+	
+	for _, session := range s.sessions {
+		if session.AssignedIP.Equal(ip) || session.AssignedIP6.Equal(ip) {
+			return session
+		}
+	}
+	return nil
+}
+
+// sendTUNPacket sends an IP packet of n bytes read into buf at
+// tunPacketOffset to a session
+func (s *Server) sendTUNPacket(session *ClientSession, buf []byte, n int) {
+	ipPacket := buf[tunPacketOffset : tunPacketOffset+n]
+	frame := buf[protocol.CompressionHeaderSize:]
+	if session.compressor != nil {
+		ipPacket = session.compressor.Compress(buf[packetHeadroom : tunPacketOffset+n])
+		frame = buf
+	}
+	if session.Capabilities&protocol.CapabilityPadding != 0 {
+		ipPacket = session.Padding.AppendPadding(ipPacket)
+	}
+	
+	// Packets too large for the transport go out as fragments,
+	// after anything batched before them
+	if protocol.HeaderSize+session.Keyring.Overhead()+len(ipPacket) > session.MaxPacketSize {
+		if session.batcher != nil {
+			session.batcher.Flush()
+		}
+		if err := session.WriteFragments(ipPacket); err != nil {
+			log.Printf("Session %d dropped packet: %v", session.ID, err)
+		}
+		s.maybeRekey(session)
+		return
+	}
+	
+	// Batch, or encrypt and send right away
+	if session.batcher != nil {
+		if err := session.batcher.Add(ipPacket); err != nil {
+			log.Printf("Session %d send error: %v", session.ID, err)
+		}
+		s.maybeRekey(session)
+		return
+	}
+	data, err := protocol.AppendSealedPacket(frame[:0], session.Keyring, session.Version, protocol.PacketTypeData, session.ID, ipPacket)
+	if err != nil {
+		// The keys are used up or destroyed, so every later
+		// packet would fail the same way
+		log.Printf("Session %d encrypt error, closing: %v", session.ID, err)
+		session.Conn.Close()
+		return
+	}
+	
+	session.Write(data)
+	s.maybeRekey(session)
+}
+
+// maybeRekey starts a rekey when the session keys are due for rotation
+func (s *Server) maybeRekey(session *ClientSession) {
+	if !session.Keyring.NeedsRekey(s.config.RekeyAfterTime, s.config.RekeyAfterBytes) {
+		return
+	}
+	
+	epoch, ephemeral, err := session.Keyring.StartRekey()
+	if err != nil {
+		log.Printf("Session %d rekey error: %v", session.ID, err)
+		return
+	}
+	
+	msg := &protocol.RekeyMessage{Kind: protocol.RekeyInit, Epoch: epoch, EphemeralPublicKey: ephemeral}
+	if err := s.sendRekey(session, msg); err != nil {
+		log.Printf("Session %d rekey send error: %v", session.ID, err)
+	}
+}
+
+// sendRekey encrypts and sends a rekey message
+func (s *Server) sendRekey(session *ClientSession, msg *protocol.RekeyMessage) error {
+	packet, err := protocol.SealPacket(session.Keyring, session.Version, protocol.PacketTypeRekey, session.ID, protocol.MarshalRekeyMessage(msg))
+	if err != nil {
+		return err
+	}
+	return session.WritePacket(packet)
+}
+
+// handleRekey processes a decrypted rekey message from a client
+func (s *Server) handleRekey(session *ClientSession, plaintext []byte) {
+	msg, err := protocol.UnmarshalRekeyMessage(plaintext)
+	if err != nil {
+		log.Printf("Session %d rekey parse error: %v", session.ID, err)
+		return
+	}
+	
+	switch msg.Kind {
+	case protocol.RekeyInit:
+		ephemeral, err := session.Keyring.HandleRekeyInit(msg.Epoch, msg.EphemeralPublicKey)
+		if err != nil {
+			log.Printf("Session %d rekey error: %v", session.ID, err)
+			return
+		}
+		resp := &protocol.RekeyMessage{Kind: protocol.RekeyResponse, Epoch: msg.Epoch, EphemeralPublicKey: ephemeral}
+		if err := s.sendRekey(session, resp); err != nil {
+			log.Printf("Session %d rekey send error: %v", session.ID, err)
+		}
 		
-		// Find session with matching IP
-		s.sessionsMu.RLock()
-		for _, session := range s.sessions {
-			if session.AssignedIP.Equal(destIP) {
-				// Encrypt and send
-				ciphertext, err := session.CryptoSession.Encrypt(buf[:n])
-				if err != nil {
-					log.Printf("Encrypt error: %v", err)
-					continue
-				}
-				
-				packet := protocol.NewPacket(protocol.PacketTypeData, session.ID, ciphertext)
-				session.Conn.Write(packet.Marshal())
-				break
-			}
+	case protocol.RekeyResponse:
+		if err := session.Keyring.HandleRekeyResponse(msg.Epoch, msg.EphemeralPublicKey); err != nil {
+			log.Printf("Session %d rekey error: %v", session.ID, err)
+			return
+		}
+		// Sent under the new keys, which lets the client switch as well
+		confirm := &protocol.RekeyMessage{Kind: protocol.RekeyConfirm, Epoch: msg.Epoch}
+		if err := s.sendRekey(session, confirm); err != nil {
+			log.Printf("Session %d rekey send error: %v", session.ID, err)
 		}
-		s.sessionsMu.RUnlock()
+		log.Printf("Rekeyed session %d to epoch %d", session.ID, msg.Epoch)
+		
+	case protocol.RekeyConfirm:
+		// Decrypting the confirmation already switched to the new keys
+		log.Printf("Rekeyed session %d to epoch %d", session.ID, msg.Epoch)
 	}
 }
 
@@ -431,11 +1504,26 @@ func (s *Server) Stop() error {
 		s.listener.Close()
 	}
 	
+	// Tell connected clients, so they back off instead of retrying at once
+	s.sessionsMu.RLock()
+	sessions := make([]*ClientSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.RUnlock()
+	s.closeSessions(sessions, &protocol.DisconnectMessage{Reason: protocol.DisconnectShutdown})
+	
 	if s.tunDevice != nil {
 		s.tunDevice.Close()
 	}
 	
 	s.wg.Wait()
+	
+	// Wipe the static key unless the caller handed it in and owns it
+	if s.config.KeyPair == nil {
+		s.keyPair.Destroy()
+	}
+	
 	log.Println("Server stopped")
 	return nil
 }
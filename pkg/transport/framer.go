@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// FrameHeaderSize is the length prefix in front of every framed message
+const FrameHeaderSize = 4
+
+// MaxFrameSize bounds the messages a Framer accepts, comfortably above the
+// largest HydraVPN packet
+const MaxFrameSize = 1 << 17
+
+// ErrFrameTooLarge is returned for messages larger than MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Framer gives a byte stream, which does not preserve message boundaries,
+// message semantics: every message is sent with a big-endian length prefix,
+// and each ReadPacket returns exactly one message. Writes may come from
+// several goroutines; reads must come from one.
+type Framer struct {
+	stream io.ReadWriter
+
+	header [FrameHeaderSize]byte // Read side length prefix
+
+	writeMu  sync.Mutex
+	writeBuf []byte // Reused so a message goes out in a single Write
+}
+
+// NewFramer wraps a byte stream
+func NewFramer(stream io.ReadWriter) *Framer {
+	return &Framer{stream: stream}
+}
+
+// ReadPacket reads the next message into b and returns its length. If the
+// message does not fit, it is consumed and io.ErrShortBuffer is returned,
+// so the stream stays in sync.
+func (f *Framer) ReadPacket(b []byte) (int, error) {
+	if _, err := io.ReadFull(f.stream, f.header[:]); err != nil {
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(f.header[:])
+	if length > MaxFrameSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+
+	// A stream that ends inside a message is cut short, not closed cleanly
+	if int(length) > len(b) {
+		if _, err := io.CopyN(io.Discard, f.stream, int64(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(f.stream, b[:length]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// WritePacket sends b as one message
+func (f *Framer) WritePacket(b []byte) (int, error) {
+	if len(b) > MaxFrameSize {
+		return 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(b))
+	}
+
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	f.writeBuf = binary.BigEndian.AppendUint32(f.writeBuf[:0], uint32(len(b)))
+	f.writeBuf = append(f.writeBuf, b...)
+	if _, err := f.stream.Write(f.writeBuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
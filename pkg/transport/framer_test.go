@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// frame returns message with its length prefix
+func frame(message []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(message))), message...)
+}
+
+// streamOf returns a stream holding the given bytes, for reading only
+func streamOf(r io.Reader) io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{r, io.Discard}
+}
+
+func TestFramerRoundTrip(t *testing.T) {
+	var stream bytes.Buffer
+	f := NewFramer(&stream)
+
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 1500), bytes.Repeat([]byte{1}, MaxFrameSize)}
+	for _, message := range messages {
+		n, err := f.WritePacket(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(message) {
+			t.Fatalf("wrote %d bytes, want %d", n, len(message))
+		}
+	}
+
+	// Messages keep their boundaries however the stream splits them
+	r := NewFramer(streamOf(iotest.OneByteReader(&stream)))
+	buf := make([]byte, MaxFrameSize)
+	for i, message := range messages {
+		n, err := r.ReadPacket(buf)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], message) {
+			t.Fatalf("message %d: read %d bytes, want %d", i, n, len(message))
+		}
+	}
+	if _, err := r.ReadPacket(buf); err != io.EOF {
+		t.Fatalf("read past the last message: err = %v, want io.EOF", err)
+	}
+}
+
+func TestFramerReadErrors(t *testing.T) {
+	tooLarge := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+	tests := []struct {
+		name    string
+		stream  []byte
+		bufSize int
+		wantErr error
+	}{
+		{name: "empty stream", stream: nil, bufSize: 16, wantErr: io.EOF},
+		{name: "truncated header", stream: []byte{0, 0}, bufSize: 16, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated message", stream: frame([]byte("hello"))[:7], bufSize: 16, wantErr: io.ErrUnexpectedEOF},
+		{name: "message without body", stream: frame([]byte("hello"))[:4], bufSize: 16, wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated oversize message", stream: frame([]byte("hello"))[:7], bufSize: 2, wantErr: io.ErrUnexpectedEOF},
+		{name: "message too large", stream: append(tooLarge, 0), bufSize: 16, wantErr: ErrFrameTooLarge},
+		{name: "buffer too small", stream: frame([]byte("hello")), bufSize: 4, wantErr: io.ErrShortBuffer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFramer(streamOf(bytes.NewReader(tt.stream)))
+			if _, err := f.ReadPacket(make([]byte, tt.bufSize)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFramerSkipsMessageTooLargeForBuffer(t *testing.T) {
+	stream := append(frame([]byte("too long for the buffer")), frame([]byte("fits"))...)
+	f := NewFramer(streamOf(bytes.NewReader(stream)))
+
+	buf := make([]byte, 8)
+	if _, err := f.ReadPacket(buf); err != io.ErrShortBuffer {
+		t.Fatalf("err = %v, want io.ErrShortBuffer", err)
+	}
+	n, err := f.ReadPacket(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "fits" {
+		t.Fatalf("read %q after the skipped message, want %q", buf[:n], "fits")
+	}
+}
+
+func TestFramerWriteTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	f := NewFramer(&stream)
+	if _, err := f.WritePacket(make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("err = %v, want ErrFrameTooLarge", err)
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("%d bytes written for a rejected message", stream.Len())
+	}
+}
+
+func FuzzFramer(f *testing.F) {
+	f.Add(frame([]byte("hello")), 16)
+	f.Add(append(frame(nil), frame([]byte("x"))...), 1)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff}, 16)
+	f.Add(frame([]byte("hello"))[:6], 3)
+
+	f.Fuzz(func(t *testing.T, data []byte, bufSize int) {
+		if bufSize < 0 || bufSize > MaxFrameSize {
+			return
+		}
+		r := NewFramer(streamOf(bytes.NewReader(data)))
+		buf := make([]byte, bufSize)
+
+		// Whatever is read must write back as the same bytes
+		var echo bytes.Buffer
+		w := NewFramer(&echo)
+		consumed := 0
+		for {
+			n, err := r.ReadPacket(buf)
+			if errors.Is(err, io.ErrShortBuffer) {
+				length := int(binary.BigEndian.Uint32(data[consumed:]))
+				echo.Write(data[consumed : consumed+FrameHeaderSize+length])
+				consumed += FrameHeaderSize + length
+				continue
+			}
+			if err != nil {
+				break
+			}
+			if _, err := w.WritePacket(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			consumed += FrameHeaderSize + n
+		}
+		if !bytes.Equal(echo.Bytes(), data[:consumed]) {
+			t.Fatal("messages read do not frame back to the stream")
+		}
+	})
+}
@@ -24,6 +24,9 @@ type ObfuscatedConnection struct {
 	keyPos int
 }
 
+// obfsMaxMessageSize is the largest packet the receiving side accepts
+const obfsMaxMessageSize = 65535
+
 // ObfuscatedListener wraps a TLS listener
 type ObfuscatedListener struct {
 	listener net.Listener
@@ -115,7 +118,7 @@ func (c *ObfuscatedConnection) Read(b []byte) (n int, err error) {
 	obfuscate(lenBuf, c.key, &tempKeyPos)
 	
 	length := binary.BigEndian.Uint32(lenBuf)
-	if length > 65535 {
+	if length > obfsMaxMessageSize {
 		return 0, fmt.Errorf("invalid packet length: %d", length)
 	}
 	
@@ -153,6 +156,11 @@ func (c *ObfuscatedConnection) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// MaxMessageSize returns the largest packet the connection carries
+func (c *ObfuscatedConnection) MaxMessageSize() int {
+	return obfsMaxMessageSize
+}
+
 // Close closes the connection
 func (c *ObfuscatedConnection) Close() error {
 	return c.conn.Close()
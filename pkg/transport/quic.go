@@ -15,10 +15,12 @@ type QUICTransport struct {
 	quicConfig *quic.Config
 }
 
-// QUICConnection wraps a QUIC stream as a Connection
+// QUICConnection wraps a QUIC stream as a Connection. The stream is framed
+// so each Read returns exactly one packet.
 type QUICConnection struct {
 	stream quic.Stream
 	conn   quic.Connection
+	framer *Framer
 }
 
 // QUICListener wraps a QUIC listener
@@ -67,6 +69,7 @@ func (t *QUICTransport) Dial(ctx context.Context, address string) (Connection, e
 	return &QUICConnection{
 		stream: stream,
 		conn:   conn,
+		framer: NewFramer(stream),
 	}, nil
 }
 
@@ -85,14 +88,19 @@ func (t *QUICTransport) Close() error {
 	return nil
 }
 
-// Read reads from the QUIC stream
+// Read reads one packet from the QUIC stream
 func (c *QUICConnection) Read(b []byte) (n int, err error) {
-	return c.stream.Read(b)
+	return c.framer.ReadPacket(b)
 }
 
-// Write writes to the QUIC stream
+// Write writes one packet to the QUIC stream
 func (c *QUICConnection) Write(b []byte) (n int, err error) {
-	return c.stream.Write(b)
+	return c.framer.WritePacket(b)
+}
+
+// MaxMessageSize returns the largest packet a framed stream carries
+func (c *QUICConnection) MaxMessageSize() int {
+	return MaxFrameSize
 }
 
 // Close closes the QUIC connection
@@ -128,6 +136,7 @@ func (l *QUICListener) Accept() (Connection, error) {
 	return &QUICConnection{
 		stream: stream,
 		conn:   conn,
+		framer: NewFramer(stream),
 	}, nil
 }
 
@@ -38,6 +38,21 @@ type Connection interface {
 	RemoteAddr() net.Addr
 }
 
+// MessageLimiter is implemented by connections that cannot carry messages
+// of any size
+type MessageLimiter interface {
+	// MaxMessageSize returns the largest message the connection carries
+	MaxMessageSize() int
+}
+
+// MessageLimit returns the largest message conn carries, capped at limit
+func MessageLimit(conn Connection, limit int) int {
+	if l, ok := conn.(MessageLimiter); ok {
+		return min(l.MaxMessageSize(), limit)
+	}
+	return limit
+}
+
 // Listener represents a transport listener
 type Listener interface {
 	// Accept accepts incoming connections
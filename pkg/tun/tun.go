@@ -3,10 +3,12 @@ package tun
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"os/exec"
 	"runtime"
 	"strings"
 
+	"github.com/hydravpn/hydra/pkg/protocol"
 	"github.com/songgao/water"
 )
 
@@ -19,12 +21,19 @@ type TUNDevice struct {
 	remoteIP net.IP
 	subnet   *net.IPNet
 
+	// IPv6 addressing, nil on IPv4-only tunnels
+	localIP6  net.IP
+	remoteIP6 net.IP
+	subnet6   *net.IPNet
+
 	// For route cleanup
 	originalGateway string
 	vpnServerIP     string
+	defaultRoute    bool // Set once SetDefaultRoute succeeded
 	
 	// For DNS cleanup
 	originalDNS     string
+	originalSearch  string
 	networkService  string // e.g., "Wi-Fi" on macOS
 }
 
@@ -35,6 +44,9 @@ type Config struct {
 	LocalIP     net.IP     // Local IP address for the interface
 	RemoteIP    net.IP     // Remote/server IP address
 	Subnet      *net.IPNet // Subnet for the VPN network
+	LocalIP6    net.IP     // Local IPv6 address (optional, enables dual-stack)
+	RemoteIP6   net.IP     // Remote/server IPv6 address
+	Subnet6     *net.IPNet // IPv6 prefix of the VPN network
 	VPNServerIP string     // Real IP of VPN server (for route exclusion)
 }
 
@@ -77,6 +89,9 @@ func New(cfg *Config) (*TUNDevice, error) {
 		localIP:     cfg.LocalIP,
 		remoteIP:    cfg.RemoteIP,
 		subnet:      cfg.Subnet,
+		localIP6:    cfg.LocalIP6,
+		remoteIP6:   cfg.RemoteIP6,
+		subnet6:     cfg.Subnet6,
 		vpnServerIP: cfg.VPNServerIP,
 	}
 
@@ -123,6 +138,16 @@ func (d *TUNDevice) configureDarwin() error {
 		}
 	}
 
+	// Add IPv6 address, which also routes its prefix to the interface
+	if d.localIP6 != nil && d.subnet6 != nil {
+		ones, _ := d.subnet6.Mask.Size()
+		cmd = exec.Command("ifconfig", d.name, "inet6", d.localIP6.String(),
+			"prefixlen", fmt.Sprintf("%d", ones), "alias")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ifconfig inet6 failed: %s: %w", string(out), err)
+		}
+	}
+
 	return nil
 }
 
@@ -143,19 +168,64 @@ func (d *TUNDevice) configureLinux() error {
 		return fmt.Errorf("ip addr add failed: %s: %w", string(out), err)
 	}
 
+	// Add IPv6 address
+	if d.localIP6 != nil && d.subnet6 != nil {
+		ones6, _ := d.subnet6.Mask.Size()
+		cmd = exec.Command("ip", "-6", "addr", "add",
+			fmt.Sprintf("%s/%d", d.localIP6.String(), ones6),
+			"dev", d.name, "nodad")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ip -6 addr add failed: %s: %w", string(out), err)
+		}
+	}
+
 	return nil
 }
 
 // SetDefaultRoute redirects all traffic through the VPN
 func (d *TUNDevice) SetDefaultRoute() error {
+	var err error
 	switch runtime.GOOS {
 	case "darwin":
-		return d.setDefaultRouteDarwin()
+		err = d.setDefaultRouteDarwin()
 	case "linux":
-		return d.setDefaultRouteLinux()
+		err = d.setDefaultRouteLinux()
 	default:
 		return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
 	}
+	if err == nil {
+		d.defaultRoute = true
+	}
+	return err
+}
+
+// AddRoutes sends traffic for the given prefixes through the VPN, leaving
+// the default route alone. The routes go away with the interface.
+func (d *TUNDevice) AddRoutes(routes []*net.IPNet) error {
+	for _, route := range routes {
+		// Only a well-formed prefix may reach the command line
+		prefix, err := netip.ParsePrefix(route.String())
+		if err != nil {
+			return fmt.Errorf("invalid route %s: %w", route, err)
+		}
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			family := "-inet"
+			if !prefix.Addr().Is4() {
+				family = "-inet6"
+			}
+			cmd = exec.Command("route", "add", family, "-net", prefix.String(), "-interface", d.name)
+		case "linux":
+			cmd = exec.Command("ip", "route", "add", prefix.String(), "dev", d.name)
+		default:
+			return fmt.Errorf("unsupported OS: %s", runtime.GOOS)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to add route %s: %s: %w", route, string(out), err)
+		}
+	}
+	return nil
 }
 
 // setDefaultRouteDarwin sets default route on macOS
@@ -187,6 +257,15 @@ func (d *TUNDevice) setDefaultRouteDarwin() error {
 	}
 
 	fmt.Printf("Default route set to VPN: %s\n", d.remoteIP.String())
+
+	// Send IPv6 through the tunnel too, so it cannot leak around it
+	if d.localIP6 != nil {
+		cmd = exec.Command("route", "add", "-inet6", "default", "-interface", d.name)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fmt.Printf("Warning: IPv6 default route: %s\n", string(out))
+		}
+	}
+
 	return nil
 }
 
@@ -200,17 +279,36 @@ func (d *TUNDevice) setDefaultRouteLinux() error {
 	d.originalGateway = gateway
 
 	// Add route to VPN server via original gateway
+	pinned := false
 	if d.vpnServerIP != "" {
 		cmd := exec.Command("ip", "route", "add", d.vpnServerIP, "via", gateway)
-		cmd.CombinedOutput() // Ignore error if exists
+		_, err := cmd.CombinedOutput() // Ignore error if exists
+		pinned = err == nil
+	}
+	unpin := func() {
+		if pinned {
+			exec.Command("ip", "route", "del", d.vpnServerIP).CombinedOutput()
+		}
 	}
 
 	// Add default route via VPN with lower metric
 	cmd := exec.Command("ip", "route", "add", "default", "via", d.remoteIP.String(), "metric", "1")
 	if out, err := cmd.CombinedOutput(); err != nil {
+		unpin()
 		return fmt.Errorf("failed to add default route: %s: %w", string(out), err)
 	}
 
+	// Send IPv6 through the tunnel too, so it cannot leak around it
+	if d.localIP6 != nil {
+		cmd = exec.Command("ip", "-6", "route", "add", "default", "dev", d.name, "metric", "1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			// Leave routing as it was rather than half switched over
+			exec.Command("ip", "route", "del", "default", "via", d.remoteIP.String()).CombinedOutput()
+			unpin()
+			return fmt.Errorf("failed to add IPv6 default route: %s: %w", string(out), err)
+		}
+	}
+
 	return nil
 }
 
@@ -232,6 +330,11 @@ func (d *TUNDevice) removeDefaultRouteDarwin() error {
 	cmd := exec.Command("route", "delete", "default")
 	cmd.CombinedOutput()
 
+	if d.localIP6 != nil {
+		cmd = exec.Command("route", "delete", "-inet6", "default", "-interface", d.name)
+		cmd.CombinedOutput()
+	}
+
 	// Restore original default route
 	if d.originalGateway != "" {
 		cmd = exec.Command("route", "add", "default", d.originalGateway)
@@ -253,6 +356,11 @@ func (d *TUNDevice) removeDefaultRouteLinux() error {
 	cmd := exec.Command("ip", "route", "del", "default", "via", d.remoteIP.String())
 	cmd.CombinedOutput()
 
+	if d.localIP6 != nil {
+		cmd = exec.Command("ip", "-6", "route", "del", "default", "dev", d.name)
+		cmd.CombinedOutput()
+	}
+
 	// Remove route to VPN server
 	if d.vpnServerIP != "" {
 		cmd = exec.Command("ip", "route", "del", d.vpnServerIP)
@@ -317,7 +425,9 @@ func (d *TUNDevice) Close() error {
 	// Restore DNS before closing
 	d.RestoreDNS()
 	// Restore routes before closing
-	d.RemoveDefaultRoute()
+	if d.defaultRoute {
+		d.RemoveDefaultRoute()
+	}
 	return d.iface.Close()
 }
 
@@ -336,20 +446,61 @@ func (d *TUNDevice) LocalIP() net.IP {
 	return d.localIP
 }
 
-// SetDNS configures DNS to use public DNS servers
-func (d *TUNDevice) SetDNS() error {
+// LocalIP6 returns the local IPv6 address, nil on IPv4-only tunnels
+func (d *TUNDevice) LocalIP6() net.IP {
+	return d.localIP6
+}
+
+// PacketDestination returns the destination address of an IPv4 or IPv6
+// packet read from a TUN device, or nil if the packet is malformed
+func PacketDestination(packet []byte) net.IP {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return nil
+		}
+		return net.IP(packet[16:20])
+	case 6:
+		if len(packet) < 40 {
+			return nil
+		}
+		return net.IP(packet[24:40])
+	default:
+		return nil
+	}
+}
+
+// SetDNS points the system resolver at the given DNS servers and, if any,
+// search domains
+func (d *TUNDevice) SetDNS(servers []net.IP, searchDomains []string) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	for _, domain := range searchDomains {
+		if !protocol.ValidSearchDomain(domain) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	addrs := make([]string, len(servers))
+	for i, server := range servers {
+		addrs[i] = server.String()
+	}
+	
 	switch runtime.GOOS {
 	case "darwin":
-		return d.setDNSDarwin()
+		return d.setDNSDarwin(addrs, searchDomains)
 	case "linux":
-		return d.setDNSLinux()
+		return d.setDNSLinux(addrs, searchDomains)
 	default:
 		return nil
 	}
 }
 
 // setDNSDarwin sets DNS on macOS
-func (d *TUNDevice) setDNSDarwin() error {
+func (d *TUNDevice) setDNSDarwin(servers, searchDomains []string) error {
 	// Find the active network service
 	service, err := getActiveNetworkService()
 	if err != nil {
@@ -363,25 +514,43 @@ func (d *TUNDevice) setDNSDarwin() error {
 	d.originalDNS = strings.TrimSpace(string(out))
 	fmt.Printf("Original DNS: %s\n", d.originalDNS)
 
-	// Set public DNS servers (Cloudflare + Google)
-	cmd = exec.Command("networksetup", "-setdnsservers", service, "1.1.1.1", "8.8.8.8")
+	// Set DNS servers
+	args := append([]string{"-setdnsservers", service}, servers...)
+	cmd = exec.Command("networksetup", args...)
 	if out, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to set DNS: %s: %w", string(out), err)
 	}
+	fmt.Printf("DNS set to: %s\n", strings.Join(servers, ", "))
+
+	// Set search domains, remembering the current ones
+	if len(searchDomains) > 0 {
+		cmd = exec.Command("networksetup", "-getsearchdomains", service)
+		out, _ := cmd.Output()
+		d.originalSearch = strings.TrimSpace(string(out))
 
-	fmt.Println("DNS set to: 1.1.1.1, 8.8.8.8")
+		args = append([]string{"-setsearchdomains", service}, searchDomains...)
+		cmd = exec.Command("networksetup", args...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to set search domains: %s: %w", string(out), err)
+		}
+		fmt.Printf("Search domains set to: %s\n", strings.Join(searchDomains, ", "))
+	}
 	return nil
 }
 
 // setDNSLinux sets DNS on Linux
-func (d *TUNDevice) setDNSLinux() error {
+func (d *TUNDevice) setDNSLinux(servers, searchDomains []string) error {
 	// On Linux, modify /etc/resolv.conf or use resolvectl
 	// For simplicity, we'll use resolvectl if available
 	cmd := exec.Command("which", "resolvectl")
 	if err := cmd.Run(); err == nil {
 		// Use systemd-resolved
-		cmd = exec.Command("resolvectl", "dns", d.name, "1.1.1.1", "8.8.8.8")
+		cmd = exec.Command("resolvectl", append([]string{"dns", d.name}, servers...)...)
 		cmd.CombinedOutput()
+		if len(searchDomains) > 0 {
+			cmd = exec.Command("resolvectl", append([]string{"domain", d.name}, searchDomains...)...)
+			cmd.CombinedOutput()
+		}
 	}
 	return nil
 }
@@ -419,6 +588,19 @@ func (d *TUNDevice) restoreDNSDarwin() error {
 		return fmt.Errorf("failed to restore DNS: %s: %w", string(out), err)
 	}
 
+	// Restore search domains if we changed them
+	if d.originalSearch != "" {
+		if strings.Contains(d.originalSearch, "There aren't any Search Domains") {
+			cmd = exec.Command("networksetup", "-setsearchdomains", d.networkService, "Empty")
+		} else {
+			args := append([]string{"-setsearchdomains", d.networkService}, strings.Fields(d.originalSearch)...)
+			cmd = exec.Command("networksetup", args...)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restore search domains: %s: %w", string(out), err)
+		}
+	}
+
 	fmt.Println("DNS restored")
 	return nil
 }